@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"fmt"
+	wasmlisher "github.com/Synternet/wasmlisher/internal"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var precompileCmd = &cobra.Command{
+	Use:   "precompile [file or dir...]",
+	Short: "Compile Wasm modules into the module cache",
+	Long:  `Compiles the given Wasm files, or all .wasm files in the given directories, into the --module-cache directory. Without arguments the modules of all streams in --config are compiled.`,
+	// Precompiling does not need NATS connections.
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		log.SetFlags(0)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		paths := args
+		if len(paths) == 0 {
+			streams, err := wasmlisher.LoadConfig(*flagConfig, nil)
+			if err != nil {
+				return fmt.Errorf("failed to load config: %w", err)
+			}
+			for _, stream := range streams {
+				paths = append(paths, stream.LocalPath)
+			}
+		}
+
+		for _, path := range paths {
+			if err := wasmlisher.Precompile(*flagModuleCache, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(precompileCmd)
+}
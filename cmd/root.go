@@ -27,6 +27,10 @@ var (
 	flagName          *string
 	flagConfig        *string
 	flagCfInterval    *int
+	flagKVStore       *string
+	flagModuleCache   *string
+	flagMaxConcurrent *int
+	flagSpillDir      *string
 
 	natsSubConnection *nats.Conn
 	natsPubConnection *nats.Conn
@@ -95,4 +99,8 @@ func init() {
 	flagName = rootCmd.PersistentFlags().StringP("name", "", os.Getenv("PUBLISHER_NAME"), "NATS subject name as in {prefix}.{name}.>")
 	flagConfig = rootCmd.PersistentFlags().StringP("config", "", os.Getenv("CONFIG_DIR"), "Wasmlisher config dir")
 	flagCfInterval = rootCmd.PersistentFlags().IntP("cfInterval", "", 60, "Wasmlisher config reload interval in seconds")
+	flagKVStore = rootCmd.PersistentFlags().StringP("kv-store", "", os.Getenv("KV_STORE"), "Plugin state store: memory, file:/path/to/db or nats:bucket")
+	flagModuleCache = rootCmd.PersistentFlags().StringP("module-cache", "", os.Getenv("MODULE_CACHE_DIR"), "Directory of precompiled Wasm modules, must only be writable by trusted users")
+	flagMaxConcurrent = rootCmd.PersistentFlags().IntP("max-concurrency", "", 0, "Maximum number of plugin calls executing at the same time across all streams, unlimited if 0")
+	flagSpillDir = rootCmd.PersistentFlags().StringP("spill-dir", "", os.Getenv("SPILL_DIR"), "Directory of the disk spill queues of spill-to-disk streams")
 }
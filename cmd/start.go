@@ -12,6 +12,8 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var flagQueueGroup *string
+
 var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "",
@@ -29,7 +31,13 @@ var startCmd = &cobra.Command{
 			dlsdk.WithVerbose(false),
 		}
 
-		wasmlisherService := wasmlisher.New(publisherOptions, *flagConfig, *flagCfInterval)
+		kvStore, err := wasmlisher.NewKVStore(*flagKVStore, natsPubConnection)
+		if err != nil {
+			log.Println("Failed to create KV store: ", err)
+			return
+		}
+
+		wasmlisherService := wasmlisher.New(publisherOptions, *flagConfig, *flagCfInterval, wasmlisher.WithKVStore(kvStore), wasmlisher.WithModuleCache(*flagModuleCache), wasmlisher.WithMaxConcurrency(*flagMaxConcurrent), wasmlisher.WithSpillDir(*flagSpillDir), wasmlisher.WithQueueGroup(*flagQueueGroup))
 
 		if wasmlisherService == nil {
 			return
@@ -51,4 +59,6 @@ var startCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(startCmd)
+
+	flagQueueGroup = startCmd.Flags().StringP("queue-group", "", os.Getenv("QUEUE_GROUP"), "NATS queue group of stream subscriptions, shares messages between replicas")
 }
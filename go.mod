@@ -9,6 +9,9 @@ require (
 	github.com/nats-io/nkeys v0.4.4
 	github.com/spf13/cobra v1.7.0
 	github.com/synternet/data-layer-sdk v0.4.2
+	go.etcd.io/bbolt v1.3.10
+	golang.org/x/sync v0.5.0
+	golang.org/x/time v0.5.0
 )
 
 require (
@@ -24,7 +27,5 @@ require (
 	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	golang.org/x/crypto v0.14.0 // indirect
-	golang.org/x/sync v0.4.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
-	golang.org/x/time v0.5.0 // indirect
 )
@@ -0,0 +1,223 @@
+package wasmlisher
+
+import (
+	"bytes"
+	"fmt"
+
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
+)
+
+// abiVersion identifies the calling convention used between the host and a plugin module.
+type abiVersion int32
+
+const (
+	// abiV0 is the original convention. The host allocates a single memoryBlockSize buffer with
+	// malloc once, copies every input into it and calls process(ptr, len) -> len. The plugin
+	// overwrites the input with its output and returns the output length.
+	abiV0 abiVersion = 0
+	// abiV1 uses dynamic buffers. For every message the host allocates exactly the input size with
+	// malloc and calls process(ptr, len) -> i64, which returns the output pointer in the upper and
+	// the output length in the lower 32 bits. After copying the output the host releases both the
+	// input and the output buffer with free(ptr).
+	abiV1 abiVersion = 1
+
+	latestABIVersion = abiV1
+
+	// abiVersionExport is the optional export through which a module declares its ABI version.
+	// It can be either an i32 global or a function without parameters returning i32.
+	abiVersionExport = "wasmlisher_abi_version"
+)
+
+// detectABI infers the calling convention from the signature of the process export.
+func detectABI(store wasmtimego.Storelike, process *wasmtimego.Func) abiVersion {
+	results := process.Type(store).Results()
+	if len(results) == 1 && results[0].Kind() == wasmtimego.KindI64 {
+		return abiV1
+	}
+	return abiV0
+}
+
+// negotiateABI returns the ABI version declared by the module through abiVersionExport.
+// Modules that don't declare a version get the convention matching their process signature,
+// which is abiV0 for all modules built before versioning was introduced.
+func negotiateABI(store wasmtimego.Storelike, instance *wasmtimego.Instance, process *wasmtimego.Func) (abiVersion, error) {
+	detected := detectABI(store, process)
+
+	export := instance.GetExport(store, abiVersionExport)
+	if export == nil {
+		return detected, nil
+	}
+
+	var version abiVersion
+	switch {
+	case export.Global() != nil:
+		val := export.Global().Get(store)
+		if val.Kind() != wasmtimego.KindI32 {
+			return 0, fmt.Errorf("%s global must be i32", abiVersionExport)
+		}
+		version = abiVersion(val.I32())
+	case export.Func() != nil:
+		val, err := export.Func().Call(store)
+		if err != nil {
+			return 0, fmt.Errorf("failed to call %s: %w", abiVersionExport, err)
+		}
+		i32, ok := val.(int32)
+		if !ok {
+			return 0, fmt.Errorf("%s must return i32", abiVersionExport)
+		}
+		version = abiVersion(i32)
+	default:
+		return 0, fmt.Errorf("%s must be a global or a function", abiVersionExport)
+	}
+
+	if version < abiV0 || version > latestABIVersion {
+		return 0, fmt.Errorf("unsupported ABI version %d, latest supported is %d", version, latestABIVersion)
+	}
+	if version != detected {
+		return 0, fmt.Errorf("process signature does not match declared ABI version %d", version)
+	}
+	return version, nil
+}
+
+// setupABI prepares the instance for its calling convention.
+func (i *wasmInstance) setupABI() error {
+	switch i.abi {
+	case abiV0:
+		memorySize := int32(i.memory.DataSize(i.store))
+		if memoryBlockSize > memorySize {
+			return fmt.Errorf("memory block size %d exceeds memory size %d", memoryBlockSize, memorySize)
+		}
+
+		// Allocate a fixed memory block once
+		ptr, err := i.allocate(memoryBlockSize)
+		if err != nil {
+			return fmt.Errorf("failed to allocate memory: %w", err)
+		}
+
+		// Ensure ptr is within bounds
+		if ptr < 0 || ptr+memoryBlockSize > memorySize {
+			return fmt.Errorf("allocated pointer is out of memory bounds: %d", ptr)
+		}
+		i.ptr = ptr
+	case abiV1:
+		if i.free == nil {
+			return fmt.Errorf("failed to get free function")
+		}
+	default:
+		return fmt.Errorf("unsupported ABI version: %d", i.abi)
+	}
+	return nil
+}
+
+// callV0 processes a message using the fixed in-place buffer.
+func (i *wasmInstance) callV0(tx []byte) ([]byte, error) {
+	txSize := int32(len(tx))
+	if txSize > memoryBlockSize {
+		return nil, fmt.Errorf("transaction size %d exceeds allocated memory block size %d", txSize, memoryBlockSize)
+	}
+
+	memoryData := i.memory.UnsafeData(i.store)
+	// Zero out the allocated memory block before copying new data
+	clear(memoryData[i.ptr : i.ptr+memoryBlockSize])
+
+	// Copy the transaction data to the allocated space in memory
+	copy(memoryData[i.ptr:i.ptr+txSize], tx)
+
+	resultVal, err := i.process.Call(i.store, i.ptr, txSize)
+	if err != nil {
+		return nil, err
+	}
+	return i.readBlock(resultVal.(int32))
+}
+
+// readBlock returns the first size bytes of the abiV0 memory block, where the plugin writes its output.
+func (i *wasmInstance) readBlock(size int32) ([]byte, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	if size > memoryBlockSize {
+		return nil, fmt.Errorf("result size %d exceeds allocated memory block size %d", size, memoryBlockSize)
+	}
+
+	memoryData := i.memory.UnsafeData(i.store)
+	return memoryData[i.ptr : i.ptr+size], nil
+}
+
+// callV1 processes a message using dynamically allocated input and output buffers.
+func (i *wasmInstance) callV1(tx []byte) ([]byte, error) {
+	inPtr, err := i.writeBuffer(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	resultVal, err := i.process.Call(i.store, inPtr, int32(len(tx)))
+	if err != nil {
+		// Instances interrupted by the timeout or fuel limit are recreated, and calling into them
+		// would trap again. Other traps keep the instance, which must not leak the input buffer.
+		if !isTrapCode(err, wasmtimego.Interrupt) && !isTrapCode(err, wasmtimego.OutOfFuel) {
+			if freeErr := i.release(inPtr); freeErr != nil {
+				return nil, fmt.Errorf("%w (failed to free input buffer: %v)", err, freeErr)
+			}
+		}
+		return nil, err
+	}
+	if err := i.release(inPtr); err != nil {
+		return nil, err
+	}
+
+	return i.readResult(resultVal.(int64))
+}
+
+// allocate reserves size bytes of plugin memory using the malloc export.
+func (i *wasmInstance) allocate(size int32) (int32, error) {
+	// Zero sized allocations may return a null pointer, which can't be told apart from a failure.
+	ptrVal, err := i.alloc.Call(i.store, max(size, 1))
+	if err != nil {
+		return 0, err
+	}
+	ptr := ptrVal.(int32)
+	if ptr <= 0 || int(ptr)+int(size) > int(i.memory.DataSize(i.store)) {
+		return 0, fmt.Errorf("allocated pointer is out of memory bounds: %d", ptr)
+	}
+	return ptr, nil
+}
+
+// release frees plugin memory using the free export.
+func (i *wasmInstance) release(ptr int32) error {
+	if ptr == 0 {
+		return nil
+	}
+	_, err := i.free.Call(i.store, ptr)
+	return err
+}
+
+// writeBuffer copies data into a newly allocated plugin buffer and returns its pointer.
+func (i *wasmInstance) writeBuffer(data []byte) (int32, error) {
+	ptr, err := i.allocate(int32(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	copy(i.memory.UnsafeData(i.store)[ptr:], data)
+	return ptr, nil
+}
+
+// readResult copies the output referenced by a packed pointer and length out of plugin memory
+// and releases the output buffer.
+func (i *wasmInstance) readResult(packed int64) ([]byte, error) {
+	outPtr := int32(uint64(packed) >> 32)
+	outLen := int32(uint32(packed))
+	if outPtr == 0 {
+		return nil, nil
+	}
+
+	memoryData := i.memory.UnsafeData(i.store)
+	if outPtr < 0 || outLen < 0 || int(outPtr)+int(outLen) > len(memoryData) {
+		return nil, fmt.Errorf("result buffer %d+%d is out of memory bounds", outPtr, outLen)
+	}
+	result := bytes.Clone(memoryData[outPtr : outPtr+outLen])
+
+	if err := i.release(outPtr); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
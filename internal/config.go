@@ -1,6 +1,7 @@
 package wasmlisher
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,17 +10,164 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// Duration is a time.Duration that is read from config either as a duration
+// string such as "500ms" or "1m", or as a number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch value := value.(type) {
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q: %w", value, err)
+		}
+		*d = Duration(parsed)
+	case nil:
+		*d = 0
+	default:
+		return fmt.Errorf("invalid duration: %s", data)
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Input types of a stream.
+const (
+	InputNats       = "nats"
+	InputJetStream  = "jetstream"
+	InputUnixSocket = "unix_socket"
+)
+
+// Output modes of a stream.
+const (
+	OutputNats      = "nats"
+	OutputJetStream = "jetstream"
 )
 
 // StreamConf represents configuration of our secondary streams.
 type StreamConf struct {
 	InputStream  string            `json:"input"`
-	InputType    string            `json:"input_type"` // "nats", "unix_socket", etc.
+	InputType    string            `json:"input_type"` // "nats", "jetstream" or "unix_socket"
 	OutputStream string            `json:"output"`
+	OutputMode   string            `json:"output_mode"` // "nats" (default) or "jetstream"
+	Mode         string            `json:"mode"`        // "stream" (default) or "reply"
 	File         string            `json:"file"`
 	Type         string            `json:"type"`
 	Env          map[string]string `json:"env"`
-	LocalPath    string
+	Timeout      Duration          `json:"timeout"`     // Maximum execution time of a single plugin call, unlimited if 0
+	QueueGroup   string            `json:"queue_group"` // NATS queue group shared with other replicas, defaults to --queue-group
+
+	// JetStream input
+	Durable       string `json:"durable"`         // Durable consumer name, required by the jetstream input
+	DeliverPolicy string `json:"deliver_policy"`  // "all" (default), "new", "last" or "last_per_subject"
+	MaxAckPending int    `json:"max_ack_pending"` // Messages in flight without an ack, server default if 0
+
+	// Parallelism
+	Workers      int    `json:"workers"`       // Number of plugin instances processing messages concurrently, 1 if 0
+	Ordered      bool   `json:"ordered"`       // Publish output of workers in input order
+	PartitionKey string `json:"partition_key"` // JSON path or "@plugin", messages with the same key go to the same worker
+
+	// Backpressure
+	BufferSize int    `json:"buffer_size"` // Capacity of the message channel, 100 if 0
+	Overflow   string `json:"overflow"`    // "block" (default), "drop-newest", "drop-oldest" or "spill-to-disk"
+
+	// Disk spill queue of the spill-to-disk overflow policy
+	SpillMaxBytes int64    `json:"spill_max_bytes"` // Oldest messages are dropped above this size, 1 GiB if 0
+	SpillMaxAge   Duration `json:"spill_max_age"`   // Messages spilled longer ago are dropped, unlimited if 0
+
+	// Scheduling under --max-concurrency
+	Priority int `json:"priority"` // Streams with a higher priority run first
+	Weight   int `json:"weight"`   // Share of streams with the same priority, 1 if 0
+
+	// Plugin lifecycle
+	Config       json.RawMessage `json:"config"`        // Passed to the plugin init export
+	TickInterval Duration        `json:"tick_interval"` // Interval of plugin tick calls, disabled if 0
+
+	// Fuel metering, disabled unless a budget is set
+	FuelPerMessage uint64   `json:"fuel_per_message"`
+	FuelPerWindow  uint64   `json:"fuel_per_window"`
+	FuelWindow     Duration `json:"fuel_window"`
+	FuelExceeded   string   `json:"fuel_exceeded"` // "throttle" (default) or "disable"
+
+	// Memory limits
+	MaxMemory       int64  `json:"max_memory"`       // Maximum linear memory size in bytes, unlimited if 0
+	InitialPages    uint64 `json:"initial_pages"`    // Memory size in 64KiB pages to grow to after instantiation
+	MemoryThreshold uint64 `json:"memory_threshold"` // Instances staying above this many bytes are recreated
+
+	KVNamespace string `json:"kv_namespace"` // Key space of the kv_* host functions, defaults to the input stream
+
+	// Plugin logging
+	Name    string  `json:"name"`     // Stream label in plugin logs, defaults to the input stream
+	LogRate float64 `json:"log_rate"` // Plugin log lines per second, 100 if 0, unlimited if negative
+
+	LocalPath string
+}
+
+// name returns the label identifying the stream in logs.
+func (s StreamConf) name() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.InputStream
+}
+
+// kvNamespace returns the key space used by the stream plugin state.
+func (s StreamConf) kvNamespace() string {
+	if s.KVNamespace != "" {
+		return s.KVNamespace
+	}
+	return s.InputStream
+}
+
+// Equal reports whether two stream configurations are identical in every field. The plugin config
+// is compared as parsed JSON, so that formatting changes don't restart a stream.
+func (s StreamConf) Equal(other StreamConf) bool {
+	return reflect.DeepEqual(s.normalized(), other.normalized())
+}
+
+// normalized returns the configuration with equivalent values replaced by a single representation.
+func (s StreamConf) normalized() StreamConf {
+	if len(s.Env) == 0 {
+		s.Env = nil
+	}
+	s.Config = normalizedJSON(s.Config)
+	return s
+}
+
+// normalizedJSON re-encodes data compactly with sorted object keys. Invalid JSON is returned as is.
+func normalizedJSON(data json.RawMessage) json.RawMessage {
+	if len(data) == 0 {
+		return nil
+	}
+	// Numbers are kept as written, so that large integers aren't rounded to equal values.
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil || decoder.More() {
+		return data
+	}
+	if value == nil {
+		return nil
+	}
+	normalized, err := json.Marshal(value)
+	if err != nil {
+		return data
+	}
+	return normalized
 }
 
 // Determine if the config string is a URL or a path
@@ -37,6 +185,38 @@ func FindStreamByInput(streams []StreamConf, inputStream string) (StreamConf, bo
 	return StreamConf{}, false
 }
 
+// DiffStreams compares two stream configurations keyed by input stream.
+// It returns streams that only exist in newStreams, streams that only exist in oldStreams
+// and streams present in both whose configuration differs (taken from newStreams).
+func DiffStreams(oldStreams, newStreams []StreamConf) (added, removed, changed []StreamConf) {
+	oldMap := make(map[string]StreamConf, len(oldStreams))
+	for _, stream := range oldStreams {
+		oldMap[stream.InputStream] = stream
+	}
+	newMap := make(map[string]StreamConf, len(newStreams))
+	for _, stream := range newStreams {
+		newMap[stream.InputStream] = stream
+	}
+
+	for input, stream := range oldMap {
+		if _, exists := newMap[input]; !exists {
+			removed = append(removed, stream)
+		}
+	}
+
+	for input, stream := range newMap {
+		oldStream, exists := oldMap[input]
+		switch {
+		case !exists:
+			added = append(added, stream)
+		case !oldStream.Equal(stream):
+			changed = append(changed, stream)
+		}
+	}
+
+	return added, removed, changed
+}
+
 func LoadConfig(config string, existingStreams []StreamConf) ([]StreamConf, error) {
 	var streams []StreamConf
 	var err error
@@ -0,0 +1,151 @@
+package wasmlisher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
+)
+
+// engineKind selects one of the shared engines. Fuel consumption is an engine wide setting that
+// slows down every call, so only streams with a fuel budget run on an engine that consumes fuel.
+type engineKind int
+
+const (
+	engineDefault engineKind = iota // Epoch interruption
+	engineFuel                      // Epoch interruption and fuel consumption
+)
+
+// engineKindOf returns the kind of engine the stream runs on.
+func engineKindOf(conf StreamConf) engineKind {
+	if conf.fuelEnabled() {
+		return engineFuel
+	}
+	return engineDefault
+}
+
+func (k engineKind) String() string {
+	if k == engineFuel {
+		return "epoch-fuel"
+	}
+	return "epoch"
+}
+
+var engines [2]struct {
+	once   sync.Once
+	engine *wasmtimego.Engine
+}
+
+// sharedEngine returns the process-wide engine of the given kind. Compiled modules can only be
+// instantiated within the engine that compiled them, so sharing it allows sharing modules.
+func sharedEngine(kind engineKind) *wasmtimego.Engine {
+	shared := &engines[kind]
+	shared.once.Do(func() {
+		config := wasmtimego.NewConfig()
+		config.SetEpochInterruption(true)
+		config.SetConsumeFuel(kind == engineFuel)
+		shared.engine = wasmtimego.NewEngineWithConfig(config)
+
+		// The engine lives as long as the process, and so does its epoch ticker.
+		startEpochTicker(shared.engine)
+	})
+	return shared.engine
+}
+
+// moduleHash identifies a module by the SHA-256 of its content.
+type moduleHash [sha256.Size]byte
+
+func (h moduleHash) short() string {
+	return hex.EncodeToString(h[:6])
+}
+
+// moduleKey identifies a compiled module by its content and the engine that compiled it.
+type moduleKey struct {
+	hash moduleHash
+	kind engineKind
+}
+
+// cachedModule is a compiled module shared by all streams using the same module content.
+type cachedModule struct {
+	once   sync.Once
+	module *wasmtimego.Module
+	err    error
+	refs   int
+	idle   bool // unused at the last prune
+}
+
+// moduleCache shares compiled modules between streams. Modules are compiled once per content
+// hash and engine, and dropped once no stream used them for two consecutive prunes. Pipelines restarted on
+// config reload load their module asynchronously, the grace period lets them reuse it.
+type moduleCache struct {
+	mu      sync.Mutex
+	modules map[moduleKey]*cachedModule
+	dir     string // Precompiled module directory, disabled if empty
+}
+
+func newModuleCache(dir string) *moduleCache {
+	return &moduleCache{modules: make(map[moduleKey]*cachedModule), dir: dir}
+}
+
+// acquire returns the module for code compiled by the engine of the given kind, compiling it if needed. Every successful
+// acquire must be paired with a release.
+func (c *moduleCache) acquire(kind engineKind, hash moduleHash, code []byte) (*wasmtimego.Module, error) {
+	key := moduleKey{hash: hash, kind: kind}
+	c.mu.Lock()
+	entry, ok := c.modules[key]
+	if !ok {
+		entry = &cachedModule{}
+		c.modules[key] = entry
+	}
+	entry.refs++
+	entry.idle = false
+	c.mu.Unlock()
+
+	// Compilation happens outside of the cache lock, so that different modules compile concurrently.
+	entry.once.Do(func() {
+		entry.module, entry.err = loadModule(c.dir, kind, hash, code)
+	})
+	if entry.err != nil {
+		// Compilation errors are not cached, so that a retry compiles again.
+		c.mu.Lock()
+		entry.refs--
+		if entry.refs == 0 && c.modules[key] == entry {
+			delete(c.modules, key)
+		}
+		c.mu.Unlock()
+		return nil, fmt.Errorf("failed to compile module: %w", entry.err)
+	}
+	return entry.module, nil
+}
+
+// release drops a reference taken by acquire.
+func (c *moduleCache) release(kind engineKind, hash moduleHash) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.modules[moduleKey{hash: hash, kind: kind}]; ok && entry.refs > 0 {
+		entry.refs--
+	}
+}
+
+// prune drops compiled modules that were not used by any stream since the previous prune.
+func (c *moduleCache) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, entry := range c.modules {
+		if entry.refs > 0 {
+			continue
+		}
+		if !entry.idle {
+			entry.idle = true
+			continue
+		}
+		if entry.module != nil {
+			entry.module.Close()
+		}
+		delete(c.modules, key)
+		log.Printf("Dropped unused compiled module %s (%s)", key.hash.short(), key.kind)
+	}
+}
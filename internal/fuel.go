@@ -0,0 +1,104 @@
+package wasmlisher
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	FuelExceededThrottle = "throttle"
+	FuelExceededDisable  = "disable"
+
+	// unlimitedFuel is the fuel given to a store when no budget applies. It is kept within
+	// int64 range as wasmtime tracks fuel internally as a signed value.
+	unlimitedFuel = math.MaxInt64
+)
+
+var (
+	ErrFuelExhausted      = errors.New("fuel exhausted")
+	ErrFuelBudgetExceeded = errors.New("fuel budget exceeded")
+)
+
+// fuelEnabled reports whether fuel metering was configured for the stream.
+func (s StreamConf) fuelEnabled() bool {
+	return s.FuelPerMessage > 0 || s.FuelPerWindow > 0
+}
+
+// fuelMeter keeps track of fuel consumed by a stream and computes the budget
+// available to the next plugin call. It is shared by all workers of the stream.
+type fuelMeter struct {
+	mu          sync.Mutex
+	perMessage  uint64
+	perWindow   uint64
+	window      time.Duration
+	windowStart time.Time
+	windowUsed  uint64
+}
+
+// newFuelMeter returns a meter for the stream or nil if fuel metering is disabled.
+func newFuelMeter(conf StreamConf) (*fuelMeter, error) {
+	if !conf.fuelEnabled() {
+		return nil, nil
+	}
+	if conf.FuelPerWindow > 0 && conf.FuelWindow <= 0 {
+		return nil, fmt.Errorf("fuel_window must be set when fuel_per_window is used")
+	}
+	switch conf.FuelExceeded {
+	case "", FuelExceededThrottle, FuelExceededDisable:
+	default:
+		return nil, fmt.Errorf("unsupported fuel_exceeded policy: %s", conf.FuelExceeded)
+	}
+
+	return &fuelMeter{
+		perMessage:  conf.FuelPerMessage,
+		perWindow:   conf.FuelPerWindow,
+		window:      time.Duration(conf.FuelWindow),
+		windowStart: time.Now(),
+	}, nil
+}
+
+// budget returns the fuel available to the next call, which is 0 once the window budget is used up.
+func (m *fuelMeter) budget(now time.Time) uint64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	budget := uint64(unlimitedFuel)
+	if m.perMessage > 0 {
+		budget = min(budget, m.perMessage)
+	}
+	if m.perWindow > 0 {
+		m.resetLocked(now)
+		budget = min(budget, m.perWindow-min(m.windowUsed, m.perWindow))
+	}
+	return budget
+}
+
+// record adds consumed fuel to the current window.
+func (m *fuelMeter) record(consumed uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.windowUsed += consumed
+}
+
+// exhausted reports whether the window budget is used up. When it is, the
+// time at which the next window starts is returned as well.
+func (m *fuelMeter) exhausted(now time.Time) (bool, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.perWindow == 0 {
+		return false, time.Time{}
+	}
+	m.resetLocked(now)
+	windowEnd := m.windowStart.Add(m.window)
+	return m.windowUsed >= m.perWindow, windowEnd
+}
+
+// resetLocked starts a new window once the current one has ended.
+func (m *fuelMeter) resetLocked(now time.Time) {
+	if now.Sub(m.windowStart) >= m.window {
+		m.windowStart = now
+		m.windowUsed = 0
+	}
+}
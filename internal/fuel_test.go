@@ -0,0 +1,33 @@
+package wasmlisher
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFuelMeterBudget(t *testing.T) {
+	start := time.Now()
+	m, err := newFuelMeter(StreamConf{FuelPerMessage: 100, FuelPerWindow: 250, FuelWindow: Duration(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.windowStart = start
+
+	for _, step := range []struct {
+		consumed uint64
+		budget   uint64
+	}{{0, 100}, {100, 100}, {100, 50}, {50, 0}, {70, 0}} {
+		m.record(step.consumed)
+		if budget := m.budget(start); budget != step.budget {
+			t.Errorf("budget after %d fuel used = %d, want %d", m.windowUsed, budget, step.budget)
+		}
+	}
+
+	// The budget of a new window is available even before the window was checked by exhausted.
+	if budget := m.budget(start.Add(time.Minute)); budget != 100 {
+		t.Errorf("budget in the next window = %d, want 100", budget)
+	}
+	if exhausted, _ := m.exhausted(start.Add(time.Minute)); exhausted {
+		t.Error("next window exhausted")
+	}
+}
@@ -0,0 +1,202 @@
+package wasmlisher
+
+import (
+	"bytes"
+	"log"
+	"log/slog"
+	"strings"
+
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
+)
+
+// hostModule is the import module name under which host functions are exposed to plugins.
+const hostModule = "wasmlisher"
+
+// Result codes returned by host functions.
+const (
+	hostOK              int32 = 0
+	hostErrMemoryBounds int32 = -1
+	hostErrSubject      int32 = -2
+	hostErrPublish      int32 = -3
+	hostErrStore        int32 = -4
+	hostErrKey          int32 = -5
+)
+
+// defineHostFunctions adds the host functions available to plugins of the stream to the linker.
+func (w *Wasmlisher) defineHostFunctions(linker *wasmtimego.Linker, conf StreamConf, logs *pluginLogger) error {
+	if err := w.definePublish(linker, conf); err != nil {
+		return err
+	}
+	if err := w.defineKV(linker, conf); err != nil {
+		return err
+	}
+	return defineLog(linker, logs)
+}
+
+func (w *Wasmlisher) definePublish(linker *wasmtimego.Linker, conf StreamConf) error {
+	// publish(subject_ptr, subject_len, data_ptr, data_len) -> result code
+	return linker.FuncWrap(hostModule, "publish", func(caller *wasmtimego.Caller, subjectPtr, subjectLen, dataPtr, dataLen int32) int32 {
+		subject, ok := callerBytes(caller, subjectPtr, subjectLen)
+		if !ok {
+			return hostErrMemoryBounds
+		}
+		data, ok := callerBytes(caller, dataPtr, dataLen)
+		if !ok {
+			return hostErrMemoryBounds
+		}
+
+		if !inSubjectNamespace(string(subject), conf.OutputStream) {
+			log.Printf("Plugin of %s tried to publish to %s outside of %s", conf.InputStream, subject, conf.OutputStream)
+			return hostErrSubject
+		}
+
+		// Plugin memory is reused once the call returns, while publishing is asynchronous.
+		if err := w.Publisher.PublishBufTo(bytes.Clone(data), string(subject)); err != nil {
+			log.Printf("Failed to publish plugin data for subject %s: %v", subject, err)
+			return hostErrPublish
+		}
+		return hostOK
+	})
+}
+
+func (w *Wasmlisher) defineKV(linker *wasmtimego.Linker, conf StreamConf) error {
+	namespace := conf.kvNamespace()
+
+	// kv_get(key_ptr, key_len) -> packed value pointer and length, 0 if the key does not exist or a negative result code.
+	// The value is allocated with the plugin malloc and must be released by the plugin.
+	err := linker.FuncWrap(hostModule, "kv_get", func(caller *wasmtimego.Caller, keyPtr, keyLen int32) int64 {
+		key, ok := callerBytes(caller, keyPtr, keyLen)
+		if !ok {
+			return int64(hostErrMemoryBounds)
+		}
+		if len(key) == 0 {
+			return int64(hostErrKey)
+		}
+
+		value, found, err := w.kv.Get(namespace, string(key))
+		if err != nil {
+			log.Printf("KV get failed for %s: %v", conf.InputStream, err)
+			return int64(hostErrStore)
+		}
+		if !found {
+			return 0
+		}
+
+		ptr, ok := callerWrite(caller, value)
+		if !ok {
+			return int64(hostErrMemoryBounds)
+		}
+		return int64(ptr)<<32 | int64(len(value))
+	})
+	if err != nil {
+		return err
+	}
+
+	// kv_set(key_ptr, key_len, value_ptr, value_len) -> result code
+	err = linker.FuncWrap(hostModule, "kv_set", func(caller *wasmtimego.Caller, keyPtr, keyLen, valuePtr, valueLen int32) int32 {
+		key, ok := callerBytes(caller, keyPtr, keyLen)
+		if !ok {
+			return hostErrMemoryBounds
+		}
+		if len(key) == 0 {
+			return hostErrKey
+		}
+		value, ok := callerBytes(caller, valuePtr, valueLen)
+		if !ok {
+			return hostErrMemoryBounds
+		}
+
+		if err := w.kv.Set(namespace, string(key), value); err != nil {
+			log.Printf("KV set failed for %s: %v", conf.InputStream, err)
+			return hostErrStore
+		}
+		return hostOK
+	})
+	if err != nil {
+		return err
+	}
+
+	// kv_delete(key_ptr, key_len) -> result code
+	return linker.FuncWrap(hostModule, "kv_delete", func(caller *wasmtimego.Caller, keyPtr, keyLen int32) int32 {
+		key, ok := callerBytes(caller, keyPtr, keyLen)
+		if !ok {
+			return hostErrMemoryBounds
+		}
+		if len(key) == 0 {
+			return hostErrKey
+		}
+
+		if err := w.kv.Delete(namespace, string(key)); err != nil {
+			log.Printf("KV delete failed for %s: %v", conf.InputStream, err)
+			return hostErrStore
+		}
+		return hostOK
+	})
+}
+
+func defineLog(linker *wasmtimego.Linker, logs *pluginLogger) error {
+	// log(level, msg_ptr, msg_len) -> result code
+	// The level follows slog: -4 debug, 0 info, 4 warn, 8 error.
+	return linker.FuncWrap(hostModule, "log", func(caller *wasmtimego.Caller, level, msgPtr, msgLen int32) int32 {
+		msg, ok := callerBytes(caller, msgPtr, msgLen)
+		if !ok {
+			return hostErrMemoryBounds
+		}
+		logs.log(slog.Level(level), string(msg), "plugin")
+		return hostOK
+	})
+}
+
+// callerBytes returns a view of plugin memory of the calling instance. The returned slice must not
+// be retained after the host function returns.
+func callerBytes(caller *wasmtimego.Caller, ptr, length int32) ([]byte, bool) {
+	export := caller.GetExport("memory")
+	if export == nil || export.Memory() == nil {
+		return nil, false
+	}
+	memoryData := export.Memory().UnsafeData(caller)
+	if ptr < 0 || length < 0 || int(ptr)+int(length) > len(memoryData) {
+		return nil, false
+	}
+	return memoryData[ptr : ptr+length], true
+}
+
+// inSubjectNamespace reports whether subject is the namespace subject itself or a subject below it.
+// Wildcards and empty tokens are never allowed.
+func inSubjectNamespace(subject, namespace string) bool {
+	if subject != namespace && !strings.HasPrefix(subject, namespace+".") {
+		return false
+	}
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" {
+			return false
+		}
+	}
+	return true
+}
+
+// callerWrite copies data into a buffer allocated with the malloc export of the calling instance
+// and returns its pointer.
+func callerWrite(caller *wasmtimego.Caller, data []byte) (int32, bool) {
+	export := caller.GetExport("malloc")
+	if export == nil || export.Func() == nil {
+		return 0, false
+	}
+	// A zero sized allocation may return a null pointer, which would read as a missing value.
+	ptrVal, err := export.Func().Call(caller, max(int32(len(data)), 1))
+	if err != nil {
+		return 0, false
+	}
+	ptr, ok := ptrVal.(int32)
+	if !ok || ptr <= 0 {
+		return 0, false
+	}
+
+	// Memory may have grown during malloc, so it is looked up afterwards.
+	buffer, ok := callerBytes(caller, ptr, int32(len(data)))
+	if !ok {
+		return 0, false
+	}
+	copy(buffer, data)
+	return ptr, true
+}
@@ -0,0 +1,233 @@
+package wasmlisher
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	dlsdk "github.com/synternet/data-layer-sdk/pkg/service"
+)
+
+// Deliver policies of the jetstream input, selecting where a new durable consumer starts.
+const (
+	DeliverAll            = "all"
+	DeliverNew            = "new"
+	DeliverLast           = "last"
+	DeliverLastPerSubject = "last_per_subject"
+)
+
+const (
+	// jetStreamFetchBatch is the maximum number of messages pulled from the consumer at once.
+	jetStreamFetchBatch = 100
+	// jetStreamFetchWait is how long a pull waits for messages before it is retried.
+	jetStreamFetchWait = 5 * time.Second
+	// jetStreamRetryDelay is the pause after a failed pull.
+	jetStreamRetryDelay = time.Second
+	// jetStreamMaxDeliveries is how often a message is delivered before a failing message is
+	// terminated instead of redelivered.
+	jetStreamMaxDeliveries = 5
+)
+
+// consumerConfig returns the durable consumer configuration of a jetstream input.
+func (s StreamConf) consumerConfig() (*nats.ConsumerConfig, error) {
+	if s.Durable == "" {
+		return nil, fmt.Errorf("%s input requires a durable consumer name", InputJetStream)
+	}
+	if s.MaxAckPending < 0 {
+		return nil, fmt.Errorf("max_ack_pending must not be negative")
+	}
+
+	config := &nats.ConsumerConfig{
+		Durable:       s.Durable,
+		FilterSubject: s.InputStream,
+		AckPolicy:     nats.AckExplicitPolicy,
+		MaxAckPending: s.MaxAckPending,
+	}
+	switch s.DeliverPolicy {
+	case "", DeliverAll:
+		config.DeliverPolicy = nats.DeliverAllPolicy
+	case DeliverNew:
+		config.DeliverPolicy = nats.DeliverNewPolicy
+	case DeliverLast:
+		config.DeliverPolicy = nats.DeliverLastPolicy
+	case DeliverLastPerSubject:
+		config.DeliverPolicy = nats.DeliverLastPerSubjectPolicy
+	default:
+		return nil, fmt.Errorf("unsupported deliver policy: %s", s.DeliverPolicy)
+	}
+	return config, nil
+}
+
+// subscribeJetStream binds the pipeline to its durable consumer, creating the consumer if it
+// doesn't exist yet, and starts pulling messages from it.
+func (w *Wasmlisher) subscribeJetStream(p *pipeline) error {
+	config, err := p.conf.consumerConfig()
+	if err != nil {
+		return err
+	}
+	jetStreamer, ok := w.subNats().(dlsdk.JetStreamer)
+	if !ok {
+		return fmt.Errorf("subscription connection does not support JetStream")
+	}
+	js, err := jetStreamer.JetStream()
+	if err != nil {
+		return fmt.Errorf("error getting JetStream context: %w", err)
+	}
+
+	stream, err := js.StreamNameBySubject(p.conf.InputStream)
+	if err != nil {
+		return fmt.Errorf("error looking up stream of %s: %w", p.conf.InputStream, err)
+	}
+	// The consumer is managed here rather than by the subscription, which would delete a consumer
+	// it created once it is unsubscribed.
+	_, err = js.ConsumerInfo(stream, config.Durable)
+	switch {
+	case errors.Is(err, nats.ErrConsumerNotFound):
+		_, err = js.AddConsumer(stream, config)
+	case err == nil:
+		_, err = js.UpdateConsumer(stream, config)
+	}
+	if err != nil {
+		return fmt.Errorf("error setting up consumer %s on stream %s: %w", config.Durable, stream, err)
+	}
+
+	sub, err := js.PullSubscribe(p.conf.InputStream, config.Durable, nats.Bind(stream, config.Durable))
+	if err != nil {
+		return fmt.Errorf("error subscribing to consumer %s: %w", config.Durable, err)
+	}
+	p.sub = sub
+
+	p.inputs.Add(1)
+	go w.consumeJetStream(p, sub)
+	return nil
+}
+
+// consumeJetStream pulls messages of the pipeline consumer until the pipeline is stopped. Messages
+// are acknowledged once their output was published and redelivered by the server otherwise.
+// With the default output mode, output counts as published once it was queued for publishing.
+func (w *Wasmlisher) consumeJetStream(p *pipeline, sub *nats.Subscription) {
+	defer p.inputs.Done()
+	for p.ctx.Err() == nil {
+		ctx, cancel := context.WithTimeout(p.ctx, jetStreamFetchWait)
+		batch, err := sub.FetchBatch(jetStreamFetchBatch, nats.Context(ctx))
+		if err == nil {
+			// Messages are handed over as they arrive, the batch ends once the pull expires.
+			for msg := range batch.Messages() {
+				if !p.deliver(message{data: msg.Data, id: jetStreamMsgID(msg), ack: jetStreamAck(p, msg)}) {
+					// Undelivered messages are redelivered once their ack wait expires.
+					cancel()
+					return
+				}
+			}
+			err = batch.Error()
+		}
+		cancel()
+
+		if err != nil {
+			if p.ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, nats.ErrTimeout) {
+				continue
+			}
+			log.Printf("Error fetching messages of %s: %v", p.conf.InputStream, err)
+			select {
+			case <-time.After(jetStreamRetryDelay):
+			case <-p.ctx.Done():
+			}
+		}
+	}
+}
+
+// jetStreamMsgID identifies a JetStream message by its stream, consumer and stream sequence, which
+// stay the same when the message is redelivered.
+func jetStreamMsgID(msg *nats.Msg) string {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s.%s.%d", meta.Stream, meta.Consumer, meta.Sequence.Stream)
+}
+
+// jetStreamAck returns the ack function of a JetStream message. Messages whose plugin call failed
+// or whose output couldn't be published are redelivered right away, until they were delivered
+// jetStreamMaxDeliveries times. Messages dropped by the overflow policy are not redelivered.
+func jetStreamAck(p *pipeline, msg *nats.Msg) func(error) {
+	return func(err error) {
+		var ackErr error
+		switch {
+		case err == nil:
+			ackErr = msg.Ack()
+		case errors.Is(err, errMessageDropped):
+			ackErr = msg.Term()
+		case jetStreamDeliveries(msg) >= jetStreamMaxDeliveries:
+			log.Printf("Giving up on message %s of %s after %d deliveries: %v", jetStreamMsgID(msg), p.conf.InputStream, jetStreamMaxDeliveries, err)
+			ackErr = msg.Term()
+		default:
+			ackErr = msg.Nak()
+		}
+		if ackErr != nil {
+			log.Printf("Error acknowledging message of %s: %v", p.conf.InputStream, ackErr)
+		}
+	}
+}
+
+// jetStreamDeliveries returns how often the message was delivered, including this delivery.
+func jetStreamDeliveries(msg *nats.Msg) uint64 {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return 0
+	}
+	return meta.NumDelivered
+}
+
+// jetStreamOutput publishes plugin output to JetStream and waits for the server to store it.
+type jetStreamOutput struct {
+	w  *Wasmlisher
+	js nats.JetStreamContext
+}
+
+func (w *Wasmlisher) newJetStreamOutput() (*jetStreamOutput, error) {
+	jetStreamer, ok := w.Publisher.PubNats.(dlsdk.JetStreamer)
+	if !ok {
+		return nil, fmt.Errorf("publishing connection does not support JetStream")
+	}
+	js, err := jetStreamer.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("error getting JetStream context: %w", err)
+	}
+	return &jetStreamOutput{w: w, js: js}, nil
+}
+
+// publish publishes plugin output like PublishWasmData. When the input message has an id, every
+// segment gets a Nats-Msg-Id made of it and the segment index, so that the output of redelivered
+// messages is deduplicated by the server.
+func (o *jetStreamOutput) publish(data []byte, subject, id string) error {
+	return publishSegments(data, subject, func(data []byte, subject string, segment int) error {
+		msg, err := o.signedMsg(data, subject)
+		if err != nil {
+			return err
+		}
+		if id != "" {
+			msg.Header.Set(nats.MsgIdHdr, id+"."+strconv.Itoa(segment))
+		}
+		_, err = o.js.PublishMsg(msg)
+		return err
+	})
+}
+
+// signedMsg builds an output message with the same headers as messages published by the Publisher.
+func (o *jetStreamOutput) signedMsg(data []byte, subject string) (*nats.Msg, error) {
+	signature, _, err := o.w.Publisher.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set("identity", o.w.Publisher.Identity)
+	msg.Header.Set("signature", base64.StdEncoding.EncodeToString(signature))
+	msg.Header.Set("timestamp", strconv.FormatInt(time.Now().UnixNano(), 10))
+	return msg, nil
+}
@@ -0,0 +1,201 @@
+package wasmlisher
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	bolt "go.etcd.io/bbolt"
+)
+
+// KVStore is a persistent key-value store backing the plugin kv_* host functions.
+// Keys are scoped by namespace, so that every stream has its own key space.
+// Values passed to Set are only valid for the duration of the call.
+type KVStore interface {
+	// Get returns the value stored under key and whether it exists.
+	Get(namespace, key string) ([]byte, bool, error)
+	Set(namespace, key string, value []byte) error
+	Delete(namespace, key string) error
+	Close() error
+}
+
+// NewKVStore creates a store from a specification string:
+//
+//	memory             in-memory store, state is lost on restart
+//	file:/path/to/db   local bbolt database file
+//	nats:bucket        NATS JetStream KV bucket, created if it does not exist
+func NewKVStore(spec string, nc *nats.Conn) (KVStore, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "", "memory":
+		return NewMemoryKVStore(), nil
+	case "file":
+		if arg == "" {
+			return nil, fmt.Errorf("file KV store requires a path")
+		}
+		return NewBoltKVStore(arg)
+	case "nats":
+		if arg == "" {
+			return nil, fmt.Errorf("nats KV store requires a bucket name")
+		}
+		if nc == nil {
+			return nil, fmt.Errorf("nats KV store requires a NATS connection")
+		}
+		return NewNatsKVStore(nc, arg)
+	default:
+		return nil, fmt.Errorf("unsupported KV store: %s", kind)
+	}
+}
+
+// MemoryKVStore keeps all values in memory.
+type MemoryKVStore struct {
+	mu     sync.RWMutex
+	values map[string]map[string][]byte
+}
+
+func NewMemoryKVStore() *MemoryKVStore {
+	return &MemoryKVStore{values: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryKVStore) Get(namespace, key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.values[namespace][key]
+	return value, ok, nil
+}
+
+func (s *MemoryKVStore) Set(namespace, key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.values[namespace] == nil {
+		s.values[namespace] = make(map[string][]byte)
+	}
+	s.values[namespace][key] = bytes.Clone(value)
+	return nil
+}
+
+func (s *MemoryKVStore) Delete(namespace, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.values[namespace], key)
+	return nil
+}
+
+func (s *MemoryKVStore) Close() error {
+	return nil
+}
+
+// BoltKVStore stores values in a local bbolt database, using a bucket per namespace.
+type BoltKVStore struct {
+	db *bolt.DB
+}
+
+func NewBoltKVStore(path string) (*BoltKVStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening KV database %s: %w", path, err)
+	}
+	return &BoltKVStore{db: db}, nil
+}
+
+func (s *BoltKVStore) Get(namespace, key string) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			return nil
+		}
+		// Values are only valid within the transaction.
+		if v := bucket.Get([]byte(key)); v != nil {
+			value = bytes.Clone(v)
+		}
+		return nil
+	})
+	return value, value != nil, err
+}
+
+func (s *BoltKVStore) Set(namespace, key string, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(namespace))
+		if err != nil {
+			return err
+		}
+		// bbolt can't tell an empty value from a missing one.
+		if value == nil {
+			value = []byte{}
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+func (s *BoltKVStore) Delete(namespace, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(namespace))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.Delete([]byte(key))
+	})
+}
+
+func (s *BoltKVStore) Close() error {
+	return s.db.Close()
+}
+
+// NatsKVStore stores values in a NATS JetStream KV bucket. As NATS keys are restricted to
+// a small character set, namespace and key are base64 encoded and joined with a dot.
+type NatsKVStore struct {
+	kv nats.KeyValue
+}
+
+func NewNatsKVStore(nc *nats.Conn, bucket string) (*NatsKVStore, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, fmt.Errorf("error creating JetStream context: %w", err)
+	}
+
+	kv, err := js.KeyValue(bucket)
+	if errors.Is(err, nats.ErrBucketNotFound) {
+		kv, err = js.CreateKeyValue(&nats.KeyValueConfig{Bucket: bucket})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening KV bucket %s: %w", bucket, err)
+	}
+	return &NatsKVStore{kv: kv}, nil
+}
+
+func natsKVKey(namespace, key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(namespace)) + "." + base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func (s *NatsKVStore) Get(namespace, key string) ([]byte, bool, error) {
+	entry, err := s.kv.Get(natsKVKey(namespace, key))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return entry.Value(), true, nil
+}
+
+func (s *NatsKVStore) Set(namespace, key string, value []byte) error {
+	_, err := s.kv.Put(natsKVKey(namespace, key), value)
+	return err
+}
+
+func (s *NatsKVStore) Delete(namespace, key string) error {
+	err := s.kv.Delete(natsKVKey(namespace, key))
+	if errors.Is(err, nats.ErrKeyNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *NatsKVStore) Close() error {
+	return nil
+}
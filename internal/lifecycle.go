@@ -0,0 +1,166 @@
+package wasmlisher
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
+)
+
+// Optional plugin lifecycle exports:
+//
+//	init(config_ptr, config_len) [-> i32]  called once per instance with the stream config,
+//	                                        a non-zero result fails the instance
+//	tick(now_unix_ms: i64) [-> i64|i32]     called every tick_interval
+//	shutdown() [-> i64|i32]                 called before the instance is dropped
+//
+// tick and shutdown may return output, which is published like process output. abiV1 plugins
+// return it in the packed pointer and length format. abiV0 plugins write it into the memory block
+// passed to process and init and return its length.
+const (
+	initExport     = "init"
+	tickExport     = "tick"
+	shutdownExport = "shutdown"
+)
+
+// setupLifecycle looks up the lifecycle exports and validates their signatures.
+func (i *wasmInstance) setupLifecycle(instance *wasmtimego.Instance) error {
+	i32, i64 := wasmtimego.KindI32, wasmtimego.KindI64
+
+	i.onInit = exportedFunc(i.store, instance, initExport)
+	if err := i.checkSignature(i.onInit, initExport, []wasmtimego.ValKind{i32, i32}, []wasmtimego.ValKind{i32}); err != nil {
+		return err
+	}
+	i.onTick = exportedFunc(i.store, instance, tickExport)
+	if err := i.checkSignature(i.onTick, tickExport, []wasmtimego.ValKind{i64}, i.outputKinds()); err != nil {
+		return err
+	}
+	i.onShutdown = exportedFunc(i.store, instance, shutdownExport)
+	return i.checkSignature(i.onShutdown, shutdownExport, nil, i.outputKinds())
+}
+
+// outputKinds returns the result types through which lifecycle exports can return output.
+func (i *wasmInstance) outputKinds() []wasmtimego.ValKind {
+	if i.abi == abiV1 {
+		return []wasmtimego.ValKind{wasmtimego.KindI64}
+	}
+	return []wasmtimego.ValKind{wasmtimego.KindI32}
+}
+
+// checkSignature verifies that fn takes params and returns either nothing or a single result of one of the results kinds.
+func (i *wasmInstance) checkSignature(fn *wasmtimego.Func, name string, params, results []wasmtimego.ValKind) error {
+	if fn == nil {
+		return nil
+	}
+	fnType := fn.Type(i.store)
+
+	valid := len(fnType.Params()) == len(params)
+	for n, param := range fnType.Params() {
+		valid = valid && param.Kind() == params[n]
+	}
+	switch fnResults := fnType.Results(); len(fnResults) {
+	case 0:
+	case 1:
+		valid = valid && slices.Contains(results, fnResults[0].Kind())
+	default:
+		valid = false
+	}
+	if !valid {
+		return fmt.Errorf("%s export has an unsupported signature", name)
+	}
+	return nil
+}
+
+// initialize passes the stream config to the init export.
+func (i *wasmInstance) initialize(config []byte, timeout Duration) error {
+	if i.onInit == nil {
+		return nil
+	}
+
+	var ptr int32
+	if len(config) > 0 {
+		var err error
+		ptr, err = i.writeInput(config)
+		if err != nil {
+			return fmt.Errorf("failed to pass config to %s: %w", initExport, err)
+		}
+	}
+
+	resultVal, err := i.invoke(i.onInit, timeout, ptr, int32(len(config)))
+	if err != nil {
+		return fmt.Errorf("%s call failed: %w", initExport, err)
+	}
+	if i.abi == abiV1 {
+		if err := i.release(ptr); err != nil {
+			return err
+		}
+	}
+	if code, ok := resultVal.(int32); ok && code != 0 {
+		return fmt.Errorf("%s returned %d", initExport, code)
+	}
+	return nil
+}
+
+// writeInput copies data passed to an export other than process into plugin memory,
+// using the fixed buffer for abiV0. For abiV1 the buffer has to be released after the call.
+func (i *wasmInstance) writeInput(data []byte) (int32, error) {
+	if i.abi == abiV1 {
+		return i.writeBuffer(data)
+	}
+	if len(data) > memoryBlockSize {
+		return 0, fmt.Errorf("input size %d exceeds allocated memory block size %d", len(data), memoryBlockSize)
+	}
+	memoryData := i.memory.UnsafeData(i.store)
+	clear(memoryData[i.ptr : i.ptr+memoryBlockSize])
+	copy(memoryData[i.ptr:], data)
+	return i.ptr, nil
+}
+
+// callTick calls the tick export, if any, and returns its output.
+func (i *wasmInstance) callTick(now time.Time, timeout Duration) ([]byte, error) {
+	if i.onTick == nil {
+		return nil, nil
+	}
+	resultVal, err := i.invoke(i.onTick, timeout, now.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	return i.lifecycleOutput(resultVal)
+}
+
+// shutdown calls the shutdown export, if any, and returns its output.
+func (i *wasmInstance) shutdown(timeout Duration) ([]byte, error) {
+	if i.onShutdown == nil {
+		return nil, nil
+	}
+	resultVal, err := i.invoke(i.onShutdown, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return i.lifecycleOutput(resultVal)
+}
+
+// lifecycleOutput returns the output of a tick or shutdown call in the format of the plugin ABI.
+func (i *wasmInstance) lifecycleOutput(resultVal any) ([]byte, error) {
+	switch result := resultVal.(type) {
+	case int64:
+		return i.readResult(result)
+	case int32:
+		return i.readBlock(result)
+	default:
+		return nil, nil
+	}
+}
+
+// invoke calls fn, aborting it with ErrExecutionTimeout once the timeout elapses.
+func (i *wasmInstance) invoke(fn *wasmtimego.Func, timeout Duration, args ...any) (any, error) {
+	i.store.SetEpochDeadline(epochDeadline(timeout))
+	defer i.store.SetEpochDeadline(noDeadline)
+
+	resultVal, err := fn.Call(i.store, args...)
+	if err != nil {
+		return nil, i.classifyError(err)
+	}
+	return resultVal, nil
+}
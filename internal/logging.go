@@ -0,0 +1,155 @@
+package wasmlisher
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultLogRate is the number of plugin log lines per second allowed when log_rate is not set.
+	defaultLogRate = 100
+	// maxLogLineSize is the longest plugin output line that is logged.
+	maxLogLineSize = 64 * 1024
+	// truncatedSuffix marks plugin output lines cut at maxLogLineSize.
+	truncatedSuffix = " [truncated]"
+)
+
+// pluginLogger routes plugin output into slog, labelled with the stream it belongs to
+// and rate limited per stream.
+type pluginLogger struct {
+	logger  *slog.Logger
+	limiter *rate.Limiter
+	dropped *atomic.Uint64
+
+	captureFailed sync.Once // Capture failures are only reported once per stream
+}
+
+func newPluginLogger(conf StreamConf, moduleHash string, dropped *atomic.Uint64) *pluginLogger {
+	limit := rate.Limit(conf.LogRate)
+	switch {
+	case conf.LogRate == 0:
+		limit = defaultLogRate
+	case conf.LogRate < 0:
+		limit = rate.Inf
+	}
+
+	return &pluginLogger{
+		logger: slog.Default().With(
+			"stream", conf.name(),
+			"input", conf.InputStream,
+			"output", conf.OutputStream,
+			"module", moduleHash,
+		),
+		limiter: rate.NewLimiter(limit, max(int(limit), 1)),
+		dropped: dropped,
+	}
+}
+
+// log emits a single plugin log record unless the stream exceeded its log rate.
+func (l *pluginLogger) log(level slog.Level, msg string, source string) {
+	if !l.limiter.Allow() {
+		l.dropped.Add(1)
+		return
+	}
+	l.logger.Log(context.Background(), level, msg, "source", source)
+}
+
+// captureOutput redirects plugin stdout and stderr into the logger. Output is read through pipes,
+// which are closed by wasmtime once the store owning the WASI configuration is closed.
+// If redirection is not possible, the plugin inherits host stdout and stderr instead.
+func (l *pluginLogger) captureOutput(wasiConfig *wasmtimego.WasiConfig) {
+	if err := l.capture(wasiConfig.SetStdoutFile, "stdout", slog.LevelInfo); err != nil {
+		l.captureFailed.Do(func() {
+			l.logger.Warn("Failed to capture plugin output, plugins write to host stdout and stderr", "err", err)
+		})
+		wasiConfig.InheritStdout()
+		wasiConfig.InheritStderr()
+		return
+	}
+	if err := l.capture(wasiConfig.SetStderrFile, "stderr", slog.LevelWarn); err != nil {
+		l.captureFailed.Do(func() {
+			l.logger.Warn("Failed to capture plugin stderr, plugins write to host stderr", "err", err)
+		})
+		wasiConfig.InheritStderr()
+	}
+}
+
+func (l *pluginLogger) capture(setFile func(string) error, source string, level slog.Level) error {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	// wasmtime opens its own descriptor for the path, ours is not needed afterwards.
+	path, err := descriptorPath(writer)
+	if err == nil {
+		err = setFile(path)
+	}
+	writer.Close()
+	if err != nil {
+		reader.Close()
+		return err
+	}
+
+	go func() {
+		defer reader.Close()
+		// Reading until the pipe is closed keeps the plugin from blocking on a full pipe.
+		r := bufio.NewReader(reader)
+		for {
+			line, err := readLogLine(r)
+			if err == nil || len(line) > 0 {
+				l.log(level, line, source)
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// descriptorPath returns a path under which the file can be opened again by this process.
+func descriptorPath(f *os.File) (string, error) {
+	switch runtime.GOOS {
+	case "linux", "android":
+		return fmt.Sprintf("/proc/self/fd/%d", f.Fd()), nil
+	case "darwin", "ios", "freebsd", "netbsd", "openbsd", "dragonfly", "solaris", "illumos":
+		return fmt.Sprintf("/dev/fd/%d", f.Fd()), nil
+	default:
+		return "", fmt.Errorf("opening file descriptors by path is not supported on %s", runtime.GOOS)
+	}
+}
+
+// readLogLine reads the next line of plugin output without its line ending. Lines longer than
+// maxLogLineSize are truncated, the rest of the line is discarded.
+func readLogLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	truncated := false
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if err == nil {
+			chunk = bytes.TrimSuffix(chunk[:len(chunk)-1], []byte("\r"))
+		}
+		room := maxLogLineSize - len(line)
+		if len(chunk) > room {
+			chunk, truncated = chunk[:room], true
+		}
+		line = append(line, chunk...)
+
+		if err != bufio.ErrBufferFull {
+			if truncated {
+				return string(line) + truncatedSuffix, err
+			}
+			return string(line), err
+		}
+	}
+}
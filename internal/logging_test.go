@@ -0,0 +1,28 @@
+package wasmlisher
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadLogLine(t *testing.T) {
+	long := strings.Repeat("x", maxLogLineSize)
+	input := "first\r\n" + long + "\n" + long + "yz\n\nlast"
+	want := []string{"first", long, long + truncatedSuffix, "", "last"}
+
+	r := bufio.NewReaderSize(strings.NewReader(input), 16)
+	for n, expected := range want {
+		line, err := readLogLine(r)
+		if line != expected {
+			t.Errorf("line %d: got %d bytes, want %d bytes", n, len(line), len(expected))
+		}
+		if n < len(want)-1 && err != nil {
+			t.Fatalf("line %d: %v", n, err)
+		}
+		if n == len(want)-1 && err != io.EOF {
+			t.Errorf("line %d: got error %v, want EOF", n, err)
+		}
+	}
+}
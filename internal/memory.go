@@ -0,0 +1,67 @@
+package wasmlisher
+
+import (
+	"errors"
+	"fmt"
+
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
+)
+
+const (
+	wasmPageSize = 65536
+	// defaultGrowPages is how many pages instance memory is grown by when initial_pages is not configured.
+	defaultGrowPages = 50
+	// memoryRecycleAfter is the number of consecutive calls after which an instance whose memory
+	// stays above the configured threshold is recreated.
+	memoryRecycleAfter = 100
+)
+
+var ErrMemoryLimitExceeded = errors.New("memory limit exceeded")
+
+// growInitialMemory grows instance memory to the configured initial size. Without one, memory is
+// grown by defaultGrowPages, but not beyond maxMemory.
+func growInitialMemory(store wasmtimego.Storelike, memory *wasmtimego.Memory, initialPages uint64, maxMemory int64) error {
+	pages := memory.Size(store)
+	if initialPages == 0 {
+		grow := uint64(defaultGrowPages)
+		if maxMemory > 0 {
+			maxPages := uint64(maxMemory / wasmPageSize)
+			if pages >= maxPages {
+				return nil
+			}
+			grow = min(grow, maxPages-pages)
+		}
+		if _, err := memory.Grow(store, grow); err != nil {
+			return fmt.Errorf("failed to grow memory by %d pages: %w", grow, err)
+		}
+		return nil
+	}
+
+	if pages >= initialPages {
+		return nil
+	}
+	if _, err := memory.Grow(store, initialPages-pages); err != nil {
+		return fmt.Errorf("failed to grow memory to %d pages: %w", initialPages, err)
+	}
+	return nil
+}
+
+// memoryWatch tracks for how many consecutive calls instance memory stayed above the recycle threshold.
+type memoryWatch struct {
+	threshold uint64
+	above     int
+}
+
+// observe records the memory size after a call and reports whether the instance should be recycled.
+func (m *memoryWatch) observe(size uint64) bool {
+	if m.threshold == 0 || size <= m.threshold {
+		m.above = 0
+		return false
+	}
+	m.above++
+	if m.above < memoryRecycleAfter {
+		return false
+	}
+	m.above = 0
+	return true
+}
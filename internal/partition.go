@@ -0,0 +1,145 @@
+package wasmlisher
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
+	"github.com/synternet/data-layer-sdk/pkg/fields"
+)
+
+const (
+	// partitionKeyExport is the optional export computing the partition key of a message:
+	// partition_key(ptr, len) -> i64. Its input is passed like process input.
+	partitionKeyExport = "partition_key"
+	// partitionKeyPlugin is the partition_key setting selecting partitionKeyExport instead of a JSON path.
+	partitionKeyPlugin = "@plugin"
+)
+
+// partitioner assigns input messages to workers by key, so that all messages with the same key
+// are processed by the same worker in input order.
+type partitioner struct {
+	workers int
+	path    []any         // JSON path of the key within the message
+	keyer   *streamRunner // Instance calling partitionKeyExport, owned by the dispatcher
+}
+
+// newPartitioner returns the partitioner configured for the stream, or nil if messages are
+// not partitioned.
+func newPartitioner(conf StreamConf, workers int, newRunner func() (*streamRunner, error)) (*partitioner, error) {
+	if conf.PartitionKey == "" || workers < 2 {
+		return nil, nil
+	}
+
+	pt := &partitioner{workers: workers}
+	if conf.PartitionKey != partitionKeyPlugin {
+		pt.path = parseJSONPath(conf.PartitionKey)
+		return pt, nil
+	}
+
+	keyer, err := newRunner()
+	if err != nil {
+		return nil, err
+	}
+	i := keyer.instance
+	if i.partition == nil {
+		keyer.close()
+		return nil, fmt.Errorf("module does not export %s", partitionKeyExport)
+	}
+	err = i.checkSignature(i.partition, partitionKeyExport, []wasmtimego.ValKind{wasmtimego.KindI32, wasmtimego.KindI32}, []wasmtimego.ValKind{wasmtimego.KindI64})
+	if err != nil {
+		keyer.close()
+		return nil, err
+	}
+	pt.keyer = keyer
+	return pt, nil
+}
+
+// parseJSONPath splits a dotted path such as "tx.messages.0.sender" into object keys and array indexes.
+// Negative numbers aren't array indexes, they are only matched as object keys.
+func parseJSONPath(path string) []any {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	var tokens []any
+	for _, token := range strings.Split(path, ".") {
+		if index, err := strconv.Atoi(token); err == nil && index >= 0 {
+			tokens = append(tokens, index)
+		} else {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// partition returns the index of the worker processing data. Only errors that should stop
+// the pipeline are returned.
+func (pt *partitioner) partition(data []byte) (int, error) {
+	var key uint64
+	if pt.keyer != nil {
+		var pluginKey int64
+		_, err := pt.keyer.run(partitionKeyExport, func(i *wasmInstance) ([]byte, error) {
+			var err error
+			pluginKey, err = i.partitionKey(data, pt.keyer.p.conf.Timeout)
+			return nil, err
+		})
+		if err != nil {
+			return 0, err
+		}
+		key = uint64(pluginKey)
+	} else {
+		hash := fnv.New64a()
+		hash.Write(pt.jsonKey(data))
+		key = hash.Sum64()
+	}
+	return int(key % uint64(pt.workers)), nil
+}
+
+// jsonKey extracts the key at the partitioner path. Messages that aren't JSON or don't contain
+// the key all get the empty key.
+func (pt *partitioner) jsonKey(data []byte) []byte {
+	var message any
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil
+	}
+	value := fields.ExtractdAny(message, pt.path...)
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []byte(value)
+	default:
+		key, _ := json.Marshal(value)
+		return key
+	}
+}
+
+func (pt *partitioner) close() {
+	if pt != nil && pt.keyer != nil {
+		pt.keyer.close()
+	}
+}
+
+// partitionKey calls the partition_key export for a message.
+func (i *wasmInstance) partitionKey(data []byte, timeout Duration) (int64, error) {
+	ptr, err := i.writeInput(data)
+	if err != nil {
+		return 0, err
+	}
+	resultVal, err := i.invoke(i.partition, timeout, ptr, int32(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	if i.abi == abiV1 {
+		if err := i.release(ptr); err != nil {
+			return 0, err
+		}
+	}
+
+	key, ok := resultVal.(int64)
+	if !ok {
+		return 0, fmt.Errorf("%s must return i64", partitionKeyExport)
+	}
+	return key, nil
+}
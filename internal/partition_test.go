@@ -0,0 +1,24 @@
+package wasmlisher
+
+import "testing"
+
+func TestPartitionerJSONKey(t *testing.T) {
+	message := []byte(`{"messages":[{"sender":"a"},{"sender":"b"}],"-1":{"sender":"c"}}`)
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"messages.1.sender", "b"},
+		{"$.messages.0.sender", "a"},
+		{"messages.2.sender", ""},
+		{"messages.-1.sender", ""},
+		{"-1.sender", "c"},
+		{"messages", `[{"sender":"a"},{"sender":"b"}]`},
+	}
+	for _, test := range tests {
+		pt := &partitioner{workers: 2, path: parseJSONPath(test.path)}
+		if key := string(pt.jsonKey(message)); key != test.want {
+			t.Errorf("%s: got key %q, want %q", test.path, key, test.want)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package wasmlisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// Overflow policies applied when the message channel of a stream is full.
+const (
+	OverflowBlock      = "block"         // Wait until there is room, stalling the input
+	OverflowDropNewest = "drop-newest"   // Discard the incoming message
+	OverflowDropOldest = "drop-oldest"   // Discard the oldest buffered message
+	OverflowSpill      = "spill-to-disk" // Append to the on-disk spill queue of the stream
+
+	defaultBufferSize = 100
+)
+
+// drainTimeout bounds how long stopping a pipeline waits for the plugin to process the buffered
+// messages. Afterwards the remaining messages are failed without being processed, and a worker
+// stuck in a plugin call is abandoned.
+var drainTimeout = 10 * time.Second
+
+// errMessageDropped is reported to the input of a message discarded by the overflow policy.
+var errMessageDropped = errors.New("message dropped")
+
+// validateBackpressure checks the buffer_size and overflow settings of a stream.
+func (s StreamConf) validateBackpressure() error {
+	if s.BufferSize < 0 {
+		return fmt.Errorf("buffer_size must not be negative")
+	}
+	switch s.Overflow {
+	case "", OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+		return nil
+	case OverflowSpill:
+		// The spill queue only keeps message data, acknowledgements would be lost.
+		if s.InputType == InputJetStream {
+			return fmt.Errorf("overflow policy %s is not supported by the %s input", OverflowSpill, InputJetStream)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported overflow policy: %s", s.Overflow)
+	}
+}
+
+// message is an input message of a pipeline.
+type message struct {
+	data []byte
+	// id identifies the message in its input for deduplication of its output. It is empty for
+	// inputs without stable message identities.
+	id string
+	// ack is called once the output of the message was published, or with the error that
+	// prevented it. It is nil for inputs without acknowledgements.
+	ack func(err error)
+	// reply receives the output of the message instead of the output subject in reply mode,
+	// or the error that prevented it.
+	reply func(data []byte, err error)
+}
+
+// done reports the outcome of processing a message without output to its input.
+func (m message) done(err error) {
+	if m.ack != nil {
+		m.ack(err)
+	}
+	if m.reply != nil {
+		m.reply(nil, err)
+	}
+}
+
+type pipelineState int32
+
+const (
+	pipelineStarting pipelineState = iota
+	pipelineRunning
+	pipelineFailed
+)
+
+func (s pipelineState) String() string {
+	switch s {
+	case pipelineStarting:
+		return "starting"
+	case pipelineRunning:
+		return "running"
+	case pipelineFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// pipeline holds every resource that was set up for a single configured stream:
+// the input (NATS subscription or Unix socket listener and its connections), the
+// message channel and the RunWasmStream goroutine that drains it.
+type pipeline struct {
+	conf       StreamConf
+	msgChannel chan message
+	ctx        context.Context
+	cancel     context.CancelFunc
+
+	// mu guards closed. Deliveries hold the read lock so that the channel
+	// is never closed while a send is in progress.
+	mu     sync.RWMutex
+	closed bool
+
+	sub      *nats.Subscription
+	service  micro.Service // Service endpoint of reply mode streams
+	listener net.Listener
+	connMu   sync.Mutex
+	conns    map[net.Conn]struct{}
+	spill    *spillQueue // Overflow queue of spill-to-disk streams
+	inputs   sync.WaitGroup
+	running  sync.WaitGroup
+	abandon  chan struct{} // Closed once the drain timeout elapsed
+
+	state atomic.Int32
+	errMu sync.Mutex
+	err   error
+
+	stats pipelineStats
+}
+
+// pipelineStats holds counters reported through the pipeline status.
+type pipelineStats struct {
+	processed       atomic.Uint64
+	ticks           atomic.Uint64
+	timeouts        atomic.Uint64
+	fuelConsumed    atomic.Uint64
+	fuelExhausted   atomic.Uint64
+	throttled       atomic.Uint64
+	memoryBytes     atomic.Uint64
+	memoryLimitHits atomic.Uint64
+	recycled        atomic.Uint64
+	logsDropped     atomic.Uint64
+	schedulerWait   atomic.Uint64
+	dropped         atomic.Uint64
+	spilled         atomic.Uint64
+	spillBytes      atomic.Uint64
+	replyErrors     atomic.Uint64
+}
+
+func (s *pipelineStats) status() map[string]string {
+	return map[string]string{
+		"processed":         strconv.FormatUint(s.processed.Load(), 10),
+		"ticks":             strconv.FormatUint(s.ticks.Load(), 10),
+		"timeouts":          strconv.FormatUint(s.timeouts.Load(), 10),
+		"fuel_consumed":     strconv.FormatUint(s.fuelConsumed.Load(), 10),
+		"fuel_exhausted":    strconv.FormatUint(s.fuelExhausted.Load(), 10),
+		"throttled":         strconv.FormatUint(s.throttled.Load(), 10),
+		"memory_bytes":      strconv.FormatUint(s.memoryBytes.Load(), 10),
+		"memory_limit":      strconv.FormatUint(s.memoryLimitHits.Load(), 10),
+		"recycled":          strconv.FormatUint(s.recycled.Load(), 10),
+		"logs_dropped":      strconv.FormatUint(s.logsDropped.Load(), 10),
+		"scheduler_wait_ms": strconv.FormatUint(s.schedulerWait.Load(), 10),
+		"dropped":           strconv.FormatUint(s.dropped.Load(), 10),
+		"spilled":           strconv.FormatUint(s.spilled.Load(), 10),
+		"spill_bytes":       strconv.FormatUint(s.spillBytes.Load(), 10),
+		"reply_errors":      strconv.FormatUint(s.replyErrors.Load(), 10),
+	}
+}
+
+func newPipeline(stream StreamConf) *pipeline {
+	ctx, cancel := context.WithCancel(context.Background())
+	bufferSize := stream.BufferSize
+	if bufferSize == 0 {
+		bufferSize = defaultBufferSize
+	}
+	return &pipeline{
+		conf:       stream,
+		msgChannel: make(chan message, bufferSize),
+		ctx:        ctx,
+		cancel:     cancel,
+		conns:      make(map[net.Conn]struct{}),
+		abandon:    make(chan struct{}),
+	}
+}
+
+// deliver hands a message over to the RunWasmStream goroutine, applying the stream overflow
+// policy when the message channel is full. It returns false if the pipeline is being stopped
+// and the message was discarded without being reported to its input. Messages dropped by the
+// overflow policy are counted and reported to their input, they count as delivered.
+func (p *pipeline) deliver(msg message) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return false
+	}
+
+	switch p.conf.Overflow {
+	case OverflowDropNewest:
+		select {
+		case p.msgChannel <- msg:
+		default:
+			p.stats.dropped.Add(1)
+			msg.done(errMessageDropped)
+		}
+		return true
+	case OverflowSpill:
+		if err := p.spill.offer(p.msgChannel, msg.data); err != nil {
+			log.Printf("Failed to spill message of %s: %v", p.conf.InputStream, err)
+			p.stats.dropped.Add(1)
+			msg.done(errMessageDropped)
+		}
+		return true
+	case OverflowDropOldest:
+		for p.ctx.Err() == nil {
+			select {
+			case p.msgChannel <- msg:
+				return true
+			default:
+			}
+			// The channel may be drained concurrently, in which case the send is retried.
+			select {
+			case oldest := <-p.msgChannel:
+				p.stats.dropped.Add(1)
+				oldest.done(errMessageDropped)
+			default:
+			}
+		}
+		return false
+	default:
+		select {
+		case p.msgChannel <- msg:
+			return true
+		case <-p.ctx.Done():
+			return false
+		}
+	}
+}
+
+func (p *pipeline) State() pipelineState {
+	return pipelineState(p.state.Load())
+}
+
+// Err returns the error that caused the pipeline to fail, if any.
+func (p *pipeline) Err() error {
+	p.errMu.Lock()
+	defer p.errMu.Unlock()
+	return p.err
+}
+
+func (p *pipeline) setRunning() {
+	p.state.Store(int32(pipelineRunning))
+}
+
+// fail marks the pipeline as failed and stops accepting new messages.
+// The pipeline resources are released once the manager restarts or removes it.
+func (p *pipeline) fail(err error) {
+	p.errMu.Lock()
+	p.err = err
+	p.errMu.Unlock()
+	p.state.Store(int32(pipelineFailed))
+	p.cancel()
+	log.Printf("Pipeline %s failed: %v", p.conf.InputStream, err)
+}
+
+// abandoned reports whether the pipeline gave up processing its buffered messages.
+func (p *pipeline) abandoned() bool {
+	select {
+	case <-p.abandon:
+		return true
+	default:
+		return false
+	}
+}
+
+// trackConn registers an accepted Unix socket connection so it is closed with the pipeline.
+// It returns false if the pipeline is already stopping.
+func (p *pipeline) trackConn(conn net.Conn) bool {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	if p.ctx.Err() != nil {
+		return false
+	}
+	p.conns[conn] = struct{}{}
+	return true
+}
+
+func (p *pipeline) untrackConn(conn net.Conn) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	delete(p.conns, conn)
+}
+
+// stop releases the pipeline input and closes its message channel, which in turn
+// terminates the RunWasmStream goroutine. It blocks until all input goroutines have
+// exited and the RunWasmStream goroutine has either exited or been abandoned after
+// drainTimeout.
+func (p *pipeline) stop() {
+	p.cancel()
+
+	if p.sub != nil {
+		if err := p.sub.Unsubscribe(); err != nil {
+			log.Printf("Error unsubscribing from %s: %v", p.conf.InputStream, err)
+		}
+	}
+	if p.service != nil {
+		if err := p.service.Stop(); err != nil {
+			log.Printf("Error stopping service of %s: %v", p.conf.InputStream, err)
+		}
+	}
+	if p.listener != nil {
+		if err := p.listener.Close(); err != nil {
+			log.Printf("Error closing Unix socket %s: %v", p.conf.InputStream, err)
+		}
+	}
+
+	p.connMu.Lock()
+	for conn := range p.conns {
+		conn.Close()
+	}
+	p.connMu.Unlock()
+
+	p.inputs.Wait()
+
+	if p.spill != nil {
+		p.spill.close()
+	}
+
+	p.mu.Lock()
+	p.closed = true
+	close(p.msgChannel)
+	p.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		p.running.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(drainTimeout):
+		log.Printf("Pipeline %s didn't process its buffered messages within %s, abandoning them", p.conf.InputStream, drainTimeout)
+		close(p.abandon)
+	}
+}
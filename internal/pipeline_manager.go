@@ -0,0 +1,346 @@
+package wasmlisher
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrManagerClosed = errors.New("pipeline manager is closed")
+
+const (
+	retryBackoffMin = 10 * time.Second
+	retryBackoffMax = 10 * time.Minute
+)
+
+// pipelineFailure tracks a stream whose pipeline failed to start or crashed,
+// together with the retry backoff.
+type pipelineFailure struct {
+	conf      StreamConf
+	err       error
+	attempts  int
+	nextRetry time.Time
+	disabled  bool // Set for streams disabled by their fuel policy, which aren't retried
+}
+
+func retryBackoff(attempts int) time.Duration {
+	backoff := retryBackoffMin
+	for i := 1; i < attempts && backoff < retryBackoffMax; i++ {
+		backoff *= 2
+	}
+	return min(backoff, retryBackoffMax)
+}
+
+// pipelineStarter creates and starts a pipeline for a stream configuration.
+type pipelineStarter func(stream StreamConf) (*pipeline, error)
+
+// pipelineManager owns the lifecycle of all running pipelines keyed by input stream.
+// All operations are safe for concurrent use. Lifecycle operations on the same input are
+// serialized, while message delivery never touches the manager as input handlers hold a
+// direct reference to their pipeline.
+type pipelineManager struct {
+	// mu guards the fields below. It is never held while a pipeline starts or stops, so that
+	// Status and List don't wait for slow streams.
+	mu        sync.Mutex
+	pipelines map[string]*pipeline
+	failures  map[string]*pipelineFailure
+	inputs    map[string]*inputLock
+	closed    bool
+
+	// ops tracks lifecycle operations in progress, Close waits for them.
+	ops sync.WaitGroup
+
+	start pipelineStarter
+}
+
+// inputLock serializes Add, Remove, Replace and RetryFailed on a single input, so that the
+// pipeline of the input is stopped before another one is started. It is held while the
+// pipeline stops, which may last until its drain timeout elapsed, without blocking other inputs.
+type inputLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newPipelineManager(start pipelineStarter) *pipelineManager {
+	return &pipelineManager{
+		pipelines: make(map[string]*pipeline),
+		failures:  make(map[string]*pipelineFailure),
+		inputs:    make(map[string]*inputLock),
+		start:     start,
+	}
+}
+
+// lockInput acquires the lifecycle lock of the input. It returns false if the manager is closed.
+func (m *pipelineManager) lockInput(input string) (unlock func(), ok bool) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil, false
+	}
+	l, exists := m.inputs[input]
+	if !exists {
+		l = &inputLock{}
+		m.inputs[input] = l
+	}
+	l.refs++
+	m.ops.Add(1)
+	m.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(m.inputs, input)
+		}
+		m.mu.Unlock()
+		m.ops.Done()
+	}, true
+}
+
+// Add starts a pipeline for the stream. It fails if a pipeline for the same input already exists.
+func (m *pipelineManager) Add(stream StreamConf) error {
+	unlock, ok := m.lockInput(stream.InputStream)
+	if !ok {
+		return ErrManagerClosed
+	}
+	defer unlock()
+
+	m.mu.Lock()
+	if _, exists := m.pipelines[stream.InputStream]; exists {
+		m.mu.Unlock()
+		return fmt.Errorf("pipeline for %s already exists", stream.InputStream)
+	}
+	delete(m.failures, stream.InputStream)
+	m.mu.Unlock()
+
+	return m.startPipeline(stream)
+}
+
+// Remove stops and forgets the pipeline for the input. It reports whether a pipeline was running.
+func (m *pipelineManager) Remove(input string) bool {
+	unlock, ok := m.lockInput(input)
+	if !ok {
+		return false
+	}
+	defer unlock()
+
+	m.mu.Lock()
+	delete(m.failures, input)
+	p := m.detachLocked(input)
+	m.mu.Unlock()
+
+	if p == nil {
+		return false
+	}
+	p.stop()
+	return true
+}
+
+// Replace stops the pipeline for the stream input, if any, and starts a new one with the given configuration.
+func (m *pipelineManager) Replace(stream StreamConf) error {
+	unlock, ok := m.lockInput(stream.InputStream)
+	if !ok {
+		return ErrManagerClosed
+	}
+	defer unlock()
+
+	m.mu.Lock()
+	p := m.detachLocked(stream.InputStream)
+	delete(m.failures, stream.InputStream)
+	m.mu.Unlock()
+
+	if p != nil {
+		p.stop()
+	}
+	return m.startPipeline(stream)
+}
+
+// RetryFailed restarts pipelines that failed to start or crashed once their retry backoff has elapsed.
+// Pipelines that have been running successfully since their last failure have their backoff reset.
+// Pipelines disabled by their fuel policy are stopped, but stay disabled until they are replaced.
+func (m *pipelineManager) RetryFailed() {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+
+	var inputs []string
+	for input, p := range m.pipelines {
+		switch p.State() {
+		case pipelineFailed:
+			inputs = append(inputs, input)
+		case pipelineRunning:
+			delete(m.failures, input)
+		}
+	}
+
+	now := time.Now()
+	for input, f := range m.failures {
+		if _, exists := m.pipelines[input]; exists || f.disabled || now.Before(f.nextRetry) {
+			continue
+		}
+		inputs = append(inputs, input)
+	}
+	m.mu.Unlock()
+
+	for _, input := range inputs {
+		m.retry(input)
+	}
+}
+
+// retry stops the pipeline of the input if it failed, so that it is restarted once its retry
+// backoff has elapsed, or restarts it if the backoff already elapsed.
+func (m *pipelineManager) retry(input string) {
+	unlock, ok := m.lockInput(input)
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	// Other operations on the input may have completed since the failure was noticed.
+	m.mu.Lock()
+	if p := m.pipelines[input]; p != nil {
+		if p.State() != pipelineFailed {
+			m.mu.Unlock()
+			return
+		}
+		m.detachLocked(input)
+		m.recordFailureLocked(p.conf, p.Err())
+		m.mu.Unlock()
+		p.stop()
+		return
+	}
+	f, exists := m.failures[input]
+	if !exists || f.disabled || time.Now().Before(f.nextRetry) {
+		m.mu.Unlock()
+		return
+	}
+	conf, attempts := f.conf, f.attempts
+	m.mu.Unlock()
+
+	log.Printf("Retrying pipeline %s (attempt %d)", input, attempts+1)
+	m.startPipeline(conf)
+}
+
+// Status reports the state of every known pipeline. It is used as a telemetry status callback.
+func (m *pipelineManager) Status() map[string]string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := make(map[string]string)
+	for input, p := range m.pipelines {
+		status["pipelines."+input+".state"] = p.State().String()
+		if err := p.Err(); err != nil {
+			status["pipelines."+input+".error"] = err.Error()
+		}
+		for k, v := range p.stats.status() {
+			status["pipelines."+input+"."+k] = v
+		}
+	}
+	for input, f := range m.failures {
+		if _, exists := m.pipelines[input]; exists {
+			continue
+		}
+		status["pipelines."+input+".error"] = f.err.Error()
+		if f.disabled {
+			status["pipelines."+input+".state"] = "disabled"
+			continue
+		}
+		status["pipelines."+input+".state"] = pipelineFailed.String()
+		status["pipelines."+input+".attempts"] = strconv.Itoa(f.attempts)
+		status["pipelines."+input+".next_retry"] = f.nextRetry.Format(time.RFC3339)
+	}
+	return status
+}
+
+// List returns configurations of all running pipelines.
+func (m *pipelineManager) List() []StreamConf {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	streams := make([]StreamConf, 0, len(m.pipelines))
+	for _, p := range m.pipelines {
+		streams = append(streams, p.conf)
+	}
+	return streams
+}
+
+// Close stops all pipelines concurrently and waits for operations in progress. Any further
+// Add or Replace calls will fail.
+func (m *pipelineManager) Close() {
+	m.mu.Lock()
+	m.closed = true
+	pipelines := m.pipelines
+	m.pipelines = make(map[string]*pipeline)
+	m.failures = make(map[string]*pipelineFailure)
+	m.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range pipelines {
+		wg.Add(1)
+		go func(p *pipeline) {
+			defer wg.Done()
+			p.stop()
+		}(p)
+	}
+	wg.Wait()
+	// Operations in progress stop the pipelines they start once they notice the manager is closed.
+	m.ops.Wait()
+}
+
+// startPipeline starts a pipeline for the stream. A failure to start is recorded so that
+// the pipeline is retried later.
+func (m *pipelineManager) startPipeline(stream StreamConf) error {
+	p, err := m.start(stream)
+
+	m.mu.Lock()
+	if m.closed {
+		// The manager was closed while the pipeline started, Close didn't see it.
+		m.mu.Unlock()
+		if err == nil {
+			p.stop()
+		}
+		return ErrManagerClosed
+	}
+	defer m.mu.Unlock()
+	if err != nil {
+		m.recordFailureLocked(stream, err)
+		return err
+	}
+	m.pipelines[stream.InputStream] = p
+	return nil
+}
+
+func (m *pipelineManager) recordFailureLocked(stream StreamConf, err error) {
+	f, exists := m.failures[stream.InputStream]
+	if !exists {
+		f = &pipelineFailure{}
+		m.failures[stream.InputStream] = f
+	}
+	f.conf = stream
+	f.err = err
+	f.attempts++
+	f.nextRetry = time.Now().Add(retryBackoff(f.attempts))
+	f.disabled = errors.Is(err, ErrFuelBudgetExceeded)
+	if f.disabled {
+		log.Printf("Pipeline %s disabled until its configuration changes: %v", stream.InputStream, err)
+		return
+	}
+	log.Printf("Pipeline %s failed (attempt %d), next retry after %s: %v", stream.InputStream, f.attempts, f.nextRetry.Format(time.RFC3339), err)
+}
+
+// detachLocked removes the pipeline for the input from the manager without stopping it.
+// It returns nil if there is no pipeline for the input.
+func (m *pipelineManager) detachLocked(input string) *pipeline {
+	p, exists := m.pipelines[input]
+	if !exists {
+		return nil
+	}
+	delete(m.pipelines, input)
+	return p
+}
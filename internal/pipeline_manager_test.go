@@ -0,0 +1,168 @@
+package wasmlisher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
+)
+
+// spinPlugin is a plugin which busy-loops for a second on every message. It runs long enough for
+// pipelines to hit the drain timeout, but finishes before goroutines are counted.
+const spinPlugin = `(module
+  (import "wasi_snapshot_preview1" "clock_time_get" (func $clock (param i32 i64 i32) (result i32)))
+  (memory (export "memory") 17)
+  (func (export "malloc") (param i32) (result i32) (i32.const 1024))
+  (func (export "process") (param i32 i32) (result i32)
+    (local $end i64)
+    (drop (call $clock (i32.const 1) (i64.const 0) (i32.const 0)))
+    (local.set $end (i64.add (i64.load (i32.const 0)) (i64.const 1000000000)))
+    (loop $spin
+      (drop (call $clock (i32.const 1) (i64.const 0) (i32.const 0)))
+      (br_if $spin (i64.lt_u (i64.load (i32.const 0)) (local.get $end))))
+    (i32.const 0)))`
+
+// TestPipelineManagerConcurrency calls every manager operation from several goroutines while
+// producers keep delivering messages to the pipelines. One of the pipelines never catches up
+// with its input, which must delay neither operations on other inputs nor Close.
+func TestPipelineManagerConcurrency(t *testing.T) {
+	defer func(timeout time.Duration) { drainTimeout = timeout }(drainTimeout)
+	drainTimeout = 500 * time.Millisecond
+
+	w := newTestWasmlisher()
+	baseline := runtime.NumGoroutine()
+	dir := t.TempDir()
+
+	spin, err := wasmtimego.Wat2Wasm(spinPlugin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spinning := testSocketStreams(dir, 3)[2]
+	spinning.LocalPath = filepath.Join(dir, "spin.wasm")
+	if err := os.WriteFile(spinning.LocalPath, spin, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	streams := append(testSocketStreams(dir, 2), spinning)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var producers sync.WaitGroup
+	for _, stream := range streams {
+		producers.Add(1)
+		go func(path string) {
+			defer producers.Done()
+			produce(ctx, path)
+		}(stream.InputStream)
+	}
+
+	// Status and List are read continuously while pipelines start and stop.
+	readersDone := make(chan struct{})
+	var readers sync.WaitGroup
+	for n := 0; n < 2; n++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-readersDone:
+					return
+				default:
+				}
+				w.pipelines.Status()
+				w.pipelines.List()
+				runtime.Gosched()
+			}
+		}()
+	}
+
+	// Operations wait for at most one pipeline of their input to stop, the previous one has
+	// stopped or was abandoned when the input lock was released.
+	const maxStop = 2 * time.Second
+	timed := func(stream StreamConf, op string, call func()) {
+		start := time.Now()
+		call()
+		if elapsed := time.Since(start); elapsed > maxStop {
+			t.Errorf("%s: %s took %s", stream.InputStream, op, elapsed)
+		}
+	}
+
+	var callers sync.WaitGroup
+	for n := 0; n < 4; n++ {
+		callers.Add(1)
+		go func(n int) {
+			defer callers.Done()
+			for round := 0; round < 10; round++ {
+				stream := streams[(n+round)%len(streams)]
+				stream.Workers = round%2 + 1
+				// Add fails while another caller runs a pipeline for the same input.
+				_ = w.pipelines.Add(stream)
+				timed(stream, "Replace", func() {
+					if err := w.pipelines.Replace(stream); err != nil {
+						t.Errorf("%s: %v", stream.InputStream, err)
+					}
+				})
+				w.pipelines.RetryFailed()
+				timed(stream, "Remove", func() {
+					w.pipelines.Remove(stream.InputStream)
+				})
+			}
+		}(n)
+	}
+	callers.Wait()
+	close(readersDone)
+	readers.Wait()
+
+	if err := w.pipelines.Add(spinning); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	producers.Wait()
+
+	timed(spinning, "Close", w.pipelines.Close)
+	if err := w.pipelines.Add(streams[0]); err != ErrManagerClosed {
+		t.Errorf("Add after Close returned %v", err)
+	}
+	if list := w.pipelines.List(); len(list) != 0 {
+		t.Errorf("%d pipelines listed after Close", len(list))
+	}
+	waitForGoroutines(t, baseline)
+}
+
+// TestPipelineManagerDisabled checks that pipelines disabled by their fuel policy aren't retried.
+func TestPipelineManagerDisabled(t *testing.T) {
+	starts := 0
+	m := newPipelineManager(func(stream StreamConf) (*pipeline, error) {
+		starts++
+		p := newPipeline(stream)
+		p.fail(fmt.Errorf("%w: test", ErrFuelBudgetExceeded))
+		return p, nil
+	})
+	stream := StreamConf{InputStream: "disabled"}
+	if err := m.Add(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	m.RetryFailed()
+	if state := m.Status()["pipelines.disabled.state"]; state != "disabled" {
+		t.Errorf("state %q after RetryFailed", state)
+	}
+	m.failures[stream.InputStream].nextRetry = time.Time{}
+	m.RetryFailed()
+	if starts != 1 {
+		t.Errorf("disabled pipeline started %d times", starts)
+	}
+
+	if err := m.Replace(stream); err != nil {
+		t.Fatal(err)
+	}
+	if starts != 2 {
+		t.Errorf("replaced pipeline started %d times", starts)
+	}
+	m.Close()
+}
@@ -0,0 +1,192 @@
+package wasmlisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testPlugin = "../wasm-plugins/btc-whale/btcwhale.wasm"
+
+// testTransaction is a plugin input without whale outputs, so that nothing is published.
+const testTransaction = `{"txid":"t","vout":[{"value":0.5,"n":0,"scriptPubKey":{"address":"a"}}]}`
+
+// newTestWasmlisher returns a Wasmlisher without NATS connections.
+func newTestWasmlisher() *Wasmlisher {
+	// Shared engines start a goroutine that is never stopped, they must exist before goroutines are counted.
+	sharedEngine(engineDefault)
+	sharedEngine(engineFuel)
+	return New(nil, "", 0)
+}
+
+// testSocketStreams returns unix_socket streams running the test plugin in dir.
+func testSocketStreams(dir string, count int) []StreamConf {
+	streams := make([]StreamConf, count)
+	for n := range streams {
+		streams[n] = StreamConf{
+			InputStream: filepath.Join(dir, fmt.Sprintf("stream%d.sock", n)),
+			InputType:   InputUnixSocket,
+			File:        testPlugin,
+			Type:        "filesystem",
+			Env:         map[string]string{"MIN_BTC_AMOUNT": "1000"},
+			BufferSize:  4,
+			LocalPath:   testPlugin,
+		}
+	}
+	return streams
+}
+
+// produce keeps writing frames to the Unix socket at path, reconnecting whenever the socket is
+// closed or missing, until ctx is cancelled.
+func produce(ctx context.Context, path string) {
+	frame := []byte(fmt.Sprintf("%0*d%s", lengthPrefixSize, len(testTransaction), testTransaction))
+	for ctx.Err() == nil {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		stop := context.AfterFunc(ctx, func() { conn.Close() })
+		for {
+			if _, err := conn.Write(frame); err != nil {
+				break
+			}
+		}
+		stop()
+		conn.Close()
+	}
+}
+
+// pipelineOf returns the running pipeline of the input.
+func pipelineOf(m *pipelineManager, input string) *pipeline {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.pipelines[input]
+}
+
+// checkStopped fails the test unless every resource of a stopped pipeline was released.
+func checkStopped(t *testing.T, p *pipeline) {
+	t.Helper()
+	if p.deliver(message{data: []byte(testTransaction)}) {
+		t.Errorf("%s: message delivered after stop", p.conf.InputStream)
+	}
+	p.connMu.Lock()
+	conns := len(p.conns)
+	p.connMu.Unlock()
+	if conns != 0 {
+		t.Errorf("%s: %d connections open after stop", p.conf.InputStream, conns)
+	}
+	if conn, err := p.listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		if conn != nil {
+			conn.Close()
+		}
+		t.Errorf("%s: listener open after stop", p.conf.InputStream)
+	}
+}
+
+// waitForGoroutines fails the test unless the number of goroutines drops to baseline.
+func waitForGoroutines(t *testing.T, baseline int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<20)
+			t.Fatalf("%d goroutines running, %d before:\n%s", runtime.NumGoroutine(), baseline, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestPipelineChurn adds, replaces and removes streams repeatedly while producers keep writing to
+// their sockets. Sending to a closed message channel would panic.
+func TestPipelineChurn(t *testing.T) {
+	w := newTestWasmlisher()
+	baseline := runtime.NumGoroutine()
+	streams := testSocketStreams(t.TempDir(), 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var producers sync.WaitGroup
+	for _, stream := range streams {
+		producers.Add(1)
+		go func(path string) {
+			defer producers.Done()
+			produce(ctx, path)
+		}(stream.InputStream)
+	}
+
+	var processed uint64
+	for round := 0; round < 10; round++ {
+		for _, stream := range streams {
+			if err := w.pipelines.Add(stream); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		for _, stream := range streams {
+			old := pipelineOf(w.pipelines, stream.InputStream)
+			stream.Workers = round%2 + 1
+			if err := w.pipelines.Replace(stream); err != nil {
+				t.Fatal(err)
+			}
+			checkStopped(t, old)
+			processed += old.stats.processed.Load()
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		for _, stream := range streams {
+			p := pipelineOf(w.pipelines, stream.InputStream)
+			if !w.pipelines.Remove(stream.InputStream) {
+				t.Fatalf("%s: no pipeline to remove", stream.InputStream)
+			}
+			checkStopped(t, p)
+			if conn, err := net.Dial("unix", stream.InputStream); err == nil {
+				conn.Close()
+				t.Errorf("%s: socket accepts connections after remove", stream.InputStream)
+			}
+			if err := p.Err(); err != nil {
+				t.Errorf("%s: pipeline failed: %v", stream.InputStream, err)
+			}
+			processed += p.stats.processed.Load()
+		}
+	}
+
+	cancel()
+	producers.Wait()
+	if processed == 0 {
+		t.Error("no message was processed")
+	}
+	w.pipelines.Close()
+	waitForGoroutines(t, baseline)
+}
+
+// TestDeliverDropNewest checks that messages queued or dropped while the pipeline stops count as
+// delivered, so that their input doesn't report them a second time.
+func TestDeliverDropNewest(t *testing.T) {
+	p := newPipeline(StreamConf{InputStream: "drop", BufferSize: 1, Overflow: OverflowDropNewest})
+	var errs []error
+	msg := message{data: []byte(testTransaction), ack: func(err error) { errs = append(errs, err) }}
+
+	// The buffered messages are still processed after cancellation.
+	p.cancel()
+	if !p.deliver(msg) {
+		t.Error("queued message reported as discarded")
+	}
+	if !p.deliver(msg) {
+		t.Error("dropped message reported as discarded")
+	}
+	if len(errs) != 1 || !errors.Is(errs[0], errMessageDropped) {
+		t.Errorf("got outcomes %v, want a single %v", errs, errMessageDropped)
+	}
+
+	p.stop()
+	if p.deliver(msg) {
+		t.Error("message delivered after stop")
+	}
+}
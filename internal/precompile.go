@@ -0,0 +1,138 @@
+package wasmlisher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
+)
+
+// engineConfigKey identifies the engine settings and target that serialized modules depend on.
+// It has to change whenever sharedEngine is configured differently or wasmtime is upgraded.
+func engineConfigKey(kind engineKind) string {
+	return "wasmtime21-" + kind.String() + "-" + runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// cachedModulePath returns the location of the serialized module within the cache directory.
+func cachedModulePath(dir string, kind engineKind, hash moduleHash) string {
+	return filepath.Join(dir, hex.EncodeToString(hash[:])+"-"+engineConfigKey(kind)+".cwasm")
+}
+
+// loadModule compiles code with the shared engine of the given kind. When a cache directory is set, the module is
+// deserialized from it if present and serialized into it after compilation otherwise.
+//
+// Serialized modules are loaded without validation, so the cache directory must only be writable
+// by trusted users.
+func loadModule(dir string, kind engineKind, hash moduleHash, code []byte) (*wasmtimego.Module, error) {
+	engine := sharedEngine(kind)
+	if dir == "" {
+		return wasmtimego.NewModule(engine, code)
+	}
+
+	path := cachedModulePath(dir, kind, hash)
+	module, err := wasmtimego.NewModuleDeserializeFile(engine, path)
+	if err == nil {
+		return module, nil
+	}
+	if _, statErr := os.Stat(path); statErr == nil {
+		log.Printf("Ignoring incompatible precompiled module %s: %v", path, err)
+	}
+
+	module, err = wasmtimego.NewModule(engine, code)
+	if err != nil {
+		return nil, err
+	}
+	if err := storeModule(path, module); err != nil {
+		log.Printf("Failed to store precompiled module %s: %v", path, err)
+	}
+	return module, nil
+}
+
+// storeModule writes the serialized module to path. The file is renamed into place, so that
+// concurrent readers never observe a partially written module.
+func storeModule(path string, module *wasmtimego.Module) error {
+	data, err := module.Serialize()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".cwasm-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Precompile compiles the module at path, or every .wasm file below it if it is a directory,
+// into the cache directory. It is used to warm the cache ahead of time, e.g. when building images.
+// Modules are compiled for both shared engines, as the engine depends on the stream configuration.
+func Precompile(cacheDir, path string) error {
+	if cacheDir == "" {
+		return errors.New("module cache directory is not set")
+	}
+
+	return filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Directories given explicitly are walked, files given explicitly are compiled regardless of extension.
+		if entry.IsDir() || (file != path && !strings.HasSuffix(file, ".wasm")) {
+			return nil
+		}
+
+		code, err := os.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read wasm file: %w", err)
+		}
+		hash := moduleHash(sha256.Sum256(code))
+		for _, kind := range []engineKind{engineDefault, engineFuel} {
+			if err := precompileModule(cacheDir, kind, hash, file, code); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// precompileModule stores the module compiled by the engine of the given kind, unless it is already cached.
+func precompileModule(cacheDir string, kind engineKind, hash moduleHash, file string, code []byte) error {
+	engine := sharedEngine(kind)
+	cached := cachedModulePath(cacheDir, kind, hash)
+
+	module, err := wasmtimego.NewModuleDeserializeFile(engine, cached)
+	if err == nil {
+		module.Close()
+		log.Printf("Module %s is already precompiled (%s)", file, kind)
+		return nil
+	}
+
+	module, err = wasmtimego.NewModule(engine, code)
+	if err != nil {
+		return fmt.Errorf("failed to compile module %s: %w", file, err)
+	}
+	defer module.Close()
+	if err := storeModule(cached, module); err != nil {
+		return fmt.Errorf("failed to store precompiled module %s: %w", file, err)
+	}
+	log.Printf("Precompiled module %s to %s", file, cached)
+	return nil
+}
@@ -0,0 +1,68 @@
+package wasmlisher
+
+import (
+	"sync"
+
+	"github.com/nats-io/nats.go"
+	dlsdkOptions "github.com/synternet/data-layer-sdk/pkg/options"
+)
+
+// queueConn wraps the subscription connection of the Publisher and subscribes subjects registered
+// with a queue group within that group. Queue subscriptions are made through the Publisher like
+// any other, so that their messages are counted in its telemetry as well.
+type queueConn struct {
+	dlsdkOptions.NatsConn
+
+	mu     sync.Mutex
+	groups map[string]string // Queue group by subject
+}
+
+func newQueueConn(nc dlsdkOptions.NatsConn) *queueConn {
+	return &queueConn{NatsConn: nc, groups: make(map[string]string)}
+}
+
+// Subscribe subscribes to the subject within its registered queue group, if any.
+func (c *queueConn) Subscribe(subject string, handler nats.MsgHandler) (*nats.Subscription, error) {
+	c.mu.Lock()
+	group := c.groups[subject]
+	c.mu.Unlock()
+
+	if group != "" {
+		return c.NatsConn.QueueSubscribe(subject, group, handler)
+	}
+	return c.NatsConn.Subscribe(subject, handler)
+}
+
+// withGroup calls subscribe with subject registered in the queue group.
+func (c *queueConn) withGroup(subject, group string, subscribe func() (*nats.Subscription, error)) (*nats.Subscription, error) {
+	c.mu.Lock()
+	c.groups[subject] = group
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.groups, subject)
+		c.mu.Unlock()
+	}()
+	return subscribe()
+}
+
+// subNats returns the subscription connection of the Publisher without the queue group wrapper.
+func (w *Wasmlisher) subNats() dlsdkOptions.NatsConn {
+	if w.subConn != nil {
+		return w.subConn.NatsConn
+	}
+	return w.Publisher.SubNats
+}
+
+// subscribeNats subscribes the pipeline to its input subject through the Publisher, within the
+// queue group of the stream, if any.
+func (w *Wasmlisher) subscribeNats(p *pipeline) (*nats.Subscription, error) {
+	subscribe := func() (*nats.Subscription, error) {
+		return w.Publisher.SubscribeTo(w.handlerInputStreamFactory(p), p.conf.InputStream)
+	}
+	if group := w.queueGroupOf(p.conf); group != "" && w.subConn != nil {
+		return w.subConn.withGroup(p.conf.InputStream, group, subscribe)
+	}
+	return subscribe()
+}
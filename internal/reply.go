@@ -0,0 +1,243 @@
+package wasmlisher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// Stream modes.
+const (
+	ModeStream = "stream" // Output is published to the output subject
+	ModeReply  = "reply"  // Output is sent back to the sender of the input message
+)
+
+const (
+	// replyServiceName is the NATS micro service name under which reply mode streams are registered.
+	replyServiceName    = "wasmlisher"
+	replyServiceVersion = "1.0.0"
+)
+
+// errPipelineStopped is replied to requests that arrive while their stream is being stopped.
+var errPipelineStopped = errors.New("stream is stopping")
+
+// invalidEndpointChars matches characters that aren't allowed in micro service endpoint names.
+var invalidEndpointChars = regexp.MustCompile(`[^A-Za-z0-9\-_]`)
+
+// validateMode checks the mode of a stream against its input.
+func (s StreamConf) validateMode() error {
+	switch s.Mode {
+	case "", ModeStream:
+		return nil
+	case ModeReply:
+		if s.InputType != InputNats && s.InputType != InputUnixSocket {
+			return fmt.Errorf("mode %s is not supported by the %s input", ModeReply, s.InputType)
+		}
+		// The spill queue only keeps message data, requests would never be answered.
+		if s.Overflow == OverflowSpill {
+			return fmt.Errorf("overflow policy %s is not supported in mode %s", OverflowSpill, ModeReply)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported mode: %s", s.Mode)
+	}
+}
+
+// serveRequests registers the pipeline as a NATS micro service endpoint on its input subject, which
+// answers every request with the plugin output or an error.
+func (w *Wasmlisher) serveRequests(p *pipeline) error {
+	nc, ok := w.subNats().(*nats.Conn)
+	if !ok {
+		return fmt.Errorf("subscription connection does not support services")
+	}
+
+	service, err := micro.AddService(nc, micro.Config{
+		Name:        replyServiceName,
+		Version:     replyServiceVersion,
+		Description: "Wasm plugin transforms",
+		StatsHandler: func(*micro.Endpoint) any {
+			return p.stats.status()
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error adding service: %w", err)
+	}
+
+	handler := micro.HandlerFunc(func(req micro.Request) {
+		msg := message{data: req.Data(), reply: func(data []byte, err error) {
+			w.respond(p, req, data, err)
+		}}
+		if !p.deliver(msg) {
+			msg.done(errPipelineStopped)
+		}
+	})
+	err = service.AddEndpoint(invalidEndpointChars.ReplaceAllString(p.conf.name(), "_"), handler,
+		micro.WithEndpointSubject(p.conf.InputStream),
+		micro.WithEndpointMetadata(map[string]string{"file": p.conf.File}),
+	)
+	if err != nil {
+		service.Stop()
+		return fmt.Errorf("error adding endpoint: %w", err)
+	}
+	p.service = service
+	return nil
+}
+
+// respond answers a request with plugin output, or with the error that prevented it in the service
+// error headers.
+func (w *Wasmlisher) respond(p *pipeline, req micro.Request, data []byte, err error) {
+	var respondErr error
+	if err != nil {
+		p.stats.replyErrors.Add(1)
+		respondErr = req.Error(replyErrorCode(err), err.Error(), nil)
+	} else {
+		respondErr = req.Respond(data)
+	}
+	if respondErr != nil {
+		log.Printf("Error replying to request on %s: %v", p.conf.InputStream, respondErr)
+	}
+}
+
+// replyErrorCode maps processing errors to the HTTP like status codes of service error replies.
+func replyErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrExecutionTimeout):
+		return "504"
+	case errors.Is(err, errMessageDropped), errors.Is(err, errPipelineStopped):
+		return "503"
+	default:
+		return "500"
+	}
+}
+
+// replyWriteTimeout is how long writing a reply to a Unix socket may block before the connection
+// is closed, so that a client that stops reading can't hold on to replies forever.
+const replyWriteTimeout = 10 * time.Second
+
+// socketReplies writes the replies to the frames of a Unix socket connection in reply mode. Replies
+// are written in the order the frames were read, using the same length prefixed framing. Errors are
+// written as frames with a negative length prefix, followed by the error message.
+//
+// Replies are written by a goroutine of the connection, so that workers never wait for the client.
+type socketReplies struct {
+	conn net.Conn
+	p    *pipeline
+	done chan struct{} // Closed once the writer returned
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*socketReply // Replies of read frames that weren't written yet, in frame order
+	closed  bool           // No more frames are read
+	failed  bool           // A reply couldn't be written, the connection is closed
+}
+
+type socketReply struct {
+	ready bool
+	data  []byte
+	err   error
+}
+
+// newSocketReplies starts the reply writer of the connection.
+func newSocketReplies(conn net.Conn, p *pipeline) *socketReplies {
+	r := &socketReplies{conn: conn, p: p, done: make(chan struct{})}
+	r.cond = sync.NewCond(&r.mu)
+	go r.run()
+	return r
+}
+
+// add reserves the reply to the next frame and returns the reply function of its message.
+func (r *socketReplies) add() func(data []byte, err error) {
+	reply := &socketReply{}
+	r.mu.Lock()
+	if !r.failed {
+		r.pending = append(r.pending, reply)
+	}
+	r.mu.Unlock()
+
+	return func(data []byte, err error) {
+		if err != nil {
+			r.p.stats.replyErrors.Add(1)
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// Output may reference instance memory, which is reused by the next call.
+		reply.ready, reply.data, reply.err = true, bytes.Clone(data), err
+		r.cond.Broadcast()
+	}
+}
+
+// run writes ready replies in frame order until the replies to all read frames were written, a
+// write fails or the pipeline is stopped.
+func (r *socketReplies) run() {
+	defer close(r.done)
+	stop := context.AfterFunc(r.p.ctx, func() {
+		r.mu.Lock()
+		r.cond.Broadcast()
+		r.mu.Unlock()
+	})
+	defer stop()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.p.ctx.Err() == nil {
+		if len(r.pending) > 0 && r.pending[0].ready {
+			reply := r.pending[0]
+			r.pending = r.pending[1:]
+
+			r.mu.Unlock()
+			err := r.write(reply)
+			r.mu.Lock()
+
+			if err != nil {
+				if r.p.ctx.Err() == nil {
+					log.Printf("Error writing reply to Unix socket, closing connection: %v", err)
+				}
+				r.failed, r.pending = true, nil
+				// Closing the connection stops the reader as well.
+				r.conn.Close()
+				return
+			}
+			continue
+		}
+		if r.closed && len(r.pending) == 0 {
+			return
+		}
+		r.cond.Wait()
+	}
+}
+
+func (r *socketReplies) write(reply *socketReply) error {
+	frame := reply.data
+	length := len(frame)
+	if reply.err != nil {
+		frame = []byte(reply.err.Error())
+		length = -len(frame)
+	}
+	if err := r.conn.SetWriteDeadline(time.Now().Add(replyWriteTimeout)); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(r.conn, "%0*d", lengthPrefixSize, length); err != nil {
+		return err
+	}
+	_, err := r.conn.Write(frame)
+	return err
+}
+
+// wait blocks until the replies to all read frames were written, the connection failed or the
+// pipeline is stopped. No frames may be added afterwards.
+func (r *socketReplies) wait() {
+	r.mu.Lock()
+	r.closed = true
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	<-r.done
+}
@@ -0,0 +1,112 @@
+package wasmlisher
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWhaleTransaction is a plugin input with a whale output. It is padded, as the plugin writes its
+// output over the input.
+var testWhaleTransaction = `{"txid":"w","vout":[{"value":2000,"n":0,"scriptPubKey":{"address":"a"}}]}` + strings.Repeat(" ", 200)
+
+func writeFrame(conn net.Conn, data string) error {
+	_, err := fmt.Fprintf(conn, "%0*d%s", lengthPrefixSize, len(data), data)
+	return err
+}
+
+func readFrame(conn net.Conn) ([]byte, error) {
+	prefix := make([]byte, lengthPrefixSize)
+	if _, err := io.ReadFull(conn, prefix); err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(string(prefix))
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		length = -length
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(conn, data)
+	return data, err
+}
+
+// replyStream starts a reply mode stream and returns a function dialing its socket.
+func replyStream(t *testing.T, workers int) func() net.Conn {
+	w := newTestWasmlisher()
+	stream := testSocketStreams(t.TempDir(), 1)[0]
+	stream.Mode = ModeReply
+	stream.Workers = workers
+	if err := w.pipelines.Add(stream); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(w.pipelines.Close)
+
+	return func() net.Conn {
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			conn, err := net.Dial("unix", stream.InputStream)
+			if err == nil {
+				t.Cleanup(func() { conn.Close() })
+				return conn
+			}
+			if time.Now().After(deadline) {
+				t.Fatal(err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// checkReplies sends frames alternating between transactions with and without whale outputs, and
+// checks that their replies arrive in the same order.
+func checkReplies(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	for n := 0; n < 20; n++ {
+		data := testTransaction
+		if n%2 == 1 {
+			data = testWhaleTransaction
+		}
+		if err := writeFrame(conn, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for n := 0; n < 20; n++ {
+		reply, err := readFrame(conn)
+		if err != nil {
+			t.Fatalf("reply %d: %v", n, err)
+		}
+		if whale := strings.Contains(string(reply), `"w"`); whale != (n%2 == 1) {
+			t.Errorf("reply %d out of order: %q", n, reply)
+		}
+	}
+}
+
+func TestSocketReplies(t *testing.T) {
+	t.Run("order", func(t *testing.T) {
+		dial := replyStream(t, 3)
+		checkReplies(t, dial())
+	})
+
+	// A client that doesn't read its replies must hold up neither the worker nor other connections.
+	t.Run("stalled client", func(t *testing.T) {
+		dial := replyStream(t, 1)
+		// The stream is running once it replied.
+		checkReplies(t, dial())
+
+		stalled := dial()
+		go func() {
+			for writeFrame(stalled, testWhaleTransaction) == nil {
+			}
+		}()
+		// Long enough for the replies to fill the socket buffer of the stalled client.
+		time.Sleep(500 * time.Millisecond)
+		checkReplies(t, dial())
+	})
+}
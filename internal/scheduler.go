@@ -0,0 +1,115 @@
+package wasmlisher
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// scheduler bounds the number of plugin calls executing concurrently across all streams.
+// Waiting calls of streams with a higher priority always run first. Streams with the same
+// priority share the available slots in proportion to their weight, using stride scheduling.
+type scheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	waiting []*schedWaiter
+	// pass is the virtual time of the most recently granted call. Streams becoming active start
+	// from it, so that idle streams can't accumulate credit.
+	pass float64
+}
+
+// schedClass is the scheduling state of a single stream.
+type schedClass struct {
+	s        *scheduler
+	priority int
+	stride   float64
+	pass     float64
+	wait     *atomic.Uint64 // Total time spent waiting for a slot, in milliseconds
+}
+
+type schedWaiter struct {
+	class *schedClass
+	ready chan struct{}
+}
+
+// newScheduler returns a scheduler allowing limit concurrent calls, or nil if limit is not positive.
+func newScheduler(limit int) *scheduler {
+	if limit <= 0 {
+		return nil
+	}
+	return &scheduler{limit: limit}
+}
+
+// newClass registers a stream with the scheduler. A nil scheduler returns a nil class,
+// which never waits.
+func (s *scheduler) newClass(conf StreamConf, wait *atomic.Uint64) *schedClass {
+	if s == nil {
+		return nil
+	}
+	return &schedClass{
+		s:        s,
+		priority: conf.Priority,
+		stride:   1 / float64(max(conf.Weight, 1)),
+		wait:     wait,
+	}
+}
+
+// acquire blocks until the stream may execute a plugin call. Every acquire must be followed by release.
+func (c *schedClass) acquire() {
+	if c == nil {
+		return
+	}
+	s := c.s
+
+	s.mu.Lock()
+	if s.running < s.limit && len(s.waiting) == 0 {
+		s.grantLocked(c)
+		s.mu.Unlock()
+		return
+	}
+	waiter := &schedWaiter{class: c, ready: make(chan struct{})}
+	s.waiting = append(s.waiting, waiter)
+	s.mu.Unlock()
+
+	start := time.Now()
+	<-waiter.ready
+	c.wait.Add(uint64(time.Since(start).Milliseconds()))
+}
+
+// release frees the slot taken by acquire and hands it to the next waiting call.
+func (c *schedClass) release() {
+	if c == nil {
+		return
+	}
+	s := c.s
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	for s.running < s.limit && len(s.waiting) > 0 {
+		next := s.nextLocked()
+		s.grantLocked(s.waiting[next].class)
+		close(s.waiting[next].ready)
+		s.waiting = append(s.waiting[:next], s.waiting[next+1:]...)
+	}
+}
+
+// nextLocked returns the index of the waiter to run next: the highest priority first, then the
+// lowest pass, then the longest waiting.
+func (s *scheduler) nextLocked() int {
+	best := 0
+	for n, waiter := range s.waiting[1:] {
+		c, b := waiter.class, s.waiting[best].class
+		if c.priority > b.priority || (c.priority == b.priority && c.pass < b.pass) {
+			best = n + 1
+		}
+	}
+	return best
+}
+
+func (s *scheduler) grantLocked(c *schedClass) {
+	s.running++
+	c.pass = max(c.pass, s.pass) + c.stride
+	s.pass = c.pass - c.stride
+}
@@ -0,0 +1,459 @@
+package wasmlisher
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSpillMaxBytes = 1 << 30
+	// spillSegmentSize is the size after which a new segment file is started. Space is reclaimed
+	// a segment at a time, once it is read or dropped to stay within the size limit.
+	spillSegmentSize = 16 << 20
+
+	// Record layout: length (4 bytes), unix nano timestamp (8 bytes), data, CRC-32 of timestamp and data (4 bytes).
+	spillHeaderSize  = 12
+	spillTrailerSize = 4
+	spillRecordSize  = spillHeaderSize + spillTrailerSize
+
+	spillSegmentExt = ".seg"
+	spillCursorFile = "cursor"
+)
+
+var errSpillCorrupt = errors.New("corrupt spill record")
+
+// spillQueue is an on-disk FIFO queue of stream messages, taking the overflow of the message channel.
+// Messages are appended to segment files and read back in order. The read position is kept in a
+// cursor file, so that messages not handed over to the plugin survive restarts. Writes are not
+// synced, so messages survive process crashes but not necessarily system crashes.
+type spillQueue struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	segSize  int64
+
+	segments    []*spillSegment // Oldest first, reading happens in the first and writing in the last
+	writer      *os.File
+	reader      *os.File
+	readOffset  int64 // Offset of the next record in the first segment
+	readRecords int   // Records already read from the first segment
+	cursor      *os.File
+	size        int64
+	count       int // Unread records
+	head        *spillRecord
+
+	notify chan struct{}
+	stats  *pipelineStats
+}
+
+type spillSegment struct {
+	id      uint64
+	size    int64
+	records int
+}
+
+type spillRecord struct {
+	data      []byte
+	timestamp time.Time
+	end       int64
+}
+
+// spillDir returns the queue directory of a stream below the spill directory.
+func spillDir(root string, conf StreamConf) string {
+	return filepath.Join(root, url.PathEscape(conf.InputStream))
+}
+
+// openSpillQueue opens the queue in dir, recovering messages left over from a previous run.
+func openSpillQueue(dir string, conf StreamConf, stats *pipelineStats) (*spillQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	maxBytes := conf.SpillMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultSpillMaxBytes
+	}
+	q := &spillQueue{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   time.Duration(conf.SpillMaxAge),
+		segSize:  min(spillSegmentSize, max(maxBytes/4, 1)),
+		notify:   make(chan struct{}, 1),
+		stats:    stats,
+	}
+	if err := q.recover(); err != nil {
+		q.close()
+		return nil, fmt.Errorf("failed to open spill queue %s: %w", dir, err)
+	}
+	if q.count > 0 {
+		log.Printf("Recovered %d spilled messages of %s", q.count, conf.InputStream)
+	}
+	return q, nil
+}
+
+// recover loads existing segments and the read position.
+func (q *spillQueue) recover() error {
+	var err error
+	q.cursor, err = os.OpenFile(filepath.Join(q.dir, spillCursorFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	var cursorID uint64
+	var cursorOffset int64
+	buf := make([]byte, 16)
+	if _, err := q.cursor.ReadAt(buf, 0); err == nil {
+		cursorID = binary.BigEndian.Uint64(buf[:8])
+		cursorOffset = int64(binary.BigEndian.Uint64(buf[8:]))
+	}
+
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+	var ids []uint64
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), spillSegmentExt)
+		if !ok {
+			continue
+		}
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		if id < cursorID {
+			// Fully read before the restart.
+			os.Remove(filepath.Join(q.dir, entry.Name()))
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+
+	for _, id := range ids {
+		segment := &spillSegment{id: id}
+		readUpTo := int64(-1)
+		if id == cursorID {
+			readUpTo = cursorOffset
+		}
+		read, err := q.scanSegment(segment, readUpTo)
+		if err != nil {
+			return err
+		}
+		if len(q.segments) == 0 {
+			q.readOffset = min(max(readUpTo, 0), segment.size)
+			q.readRecords = read
+		}
+		q.segments = append(q.segments, segment)
+		q.size += segment.size
+		q.count += segment.records
+	}
+	q.count -= q.readRecords
+
+	if len(q.segments) == 0 {
+		q.segments = append(q.segments, &spillSegment{id: cursorID})
+	}
+	if err := q.openWriter(); err != nil {
+		return err
+	}
+	if err := q.openReader(); err != nil {
+		return err
+	}
+	q.stats.spillBytes.Store(uint64(q.size))
+	return nil
+}
+
+// scanSegment counts the valid records of a segment and truncates a torn or corrupt tail,
+// e.g. after a crash during a write. It returns the number of records before readUpTo.
+func (q *spillQueue) scanSegment(segment *spillSegment, readUpTo int64) (int, error) {
+	path := q.segmentPath(segment.id)
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	read := 0
+	var offset int64
+	for {
+		record, err := readSpillRecord(file, offset, info.Size())
+		if err != nil {
+			break
+		}
+		if offset < readUpTo {
+			read++
+		}
+		offset = record.end
+		segment.records++
+	}
+	segment.size = offset
+
+	if info.Size() > offset {
+		log.Printf("Truncating spill segment %s from %d to %d bytes", path, info.Size(), offset)
+		if err := os.Truncate(path, offset); err != nil {
+			return 0, err
+		}
+	}
+	return read, nil
+}
+
+// readSpillRecord reads the record at offset of a segment of the given size.
+func readSpillRecord(file *os.File, offset, size int64) (*spillRecord, error) {
+	header := make([]byte, spillHeaderSize)
+	if _, err := file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:4]))
+	if offset+spillRecordSize+length > size {
+		return nil, errSpillCorrupt
+	}
+
+	body := make([]byte, length+spillTrailerSize)
+	if _, err := file.ReadAt(body, offset+spillHeaderSize); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, errSpillCorrupt
+		}
+		return nil, err
+	}
+	data := body[:length]
+	checksum := crc32.Update(crc32.ChecksumIEEE(header[4:]), crc32.IEEETable, data)
+	if checksum != binary.BigEndian.Uint32(body[length:]) {
+		return nil, errSpillCorrupt
+	}
+
+	return &spillRecord{
+		data:      data,
+		timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(header[4:]))),
+		end:       offset + spillRecordSize + length,
+	}, nil
+}
+
+func (q *spillQueue) segmentPath(id uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", id, spillSegmentExt))
+}
+
+func (q *spillQueue) openWriter() error {
+	if q.writer != nil {
+		q.writer.Close()
+	}
+	var err error
+	q.writer, err = os.OpenFile(q.segmentPath(q.segments[len(q.segments)-1].id), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	return err
+}
+
+func (q *spillQueue) openReader() error {
+	if q.reader != nil {
+		q.reader.Close()
+	}
+	var err error
+	q.reader, err = os.Open(q.segmentPath(q.segments[0].id))
+	return err
+}
+
+// offer sends data straight to ch while nothing is spilled and appends it to the queue otherwise,
+// so that messages keep their order.
+func (q *spillQueue) offer(ch chan<- message, data []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.count == 0 {
+		select {
+		case ch <- message{data: data}:
+			return nil
+		default:
+		}
+	}
+
+	if err := q.pushLocked(data); err != nil {
+		return err
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *spillQueue) pushLocked(data []byte) error {
+	recordSize := int64(len(data)) + spillRecordSize
+	if recordSize > q.maxBytes {
+		// Dropping queued messages wouldn't make room for it.
+		q.stats.dropped.Add(1)
+		return nil
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+recordSize > q.segSize {
+		segment := &spillSegment{id: last.id + 1}
+		q.segments = append(q.segments, segment)
+		if err := q.openWriter(); err != nil {
+			return err
+		}
+		last = segment
+	}
+
+	// Make room by dropping the oldest segments. The segment being written is never dropped.
+	for q.size+recordSize > q.maxBytes && len(q.segments) > 1 {
+		if err := q.dropOldestLocked(); err != nil {
+			return err
+		}
+	}
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[:4], uint32(len(data)))
+	binary.BigEndian.PutUint64(record[4:12], uint64(time.Now().UnixNano()))
+	copy(record[spillHeaderSize:], data)
+	checksum := crc32.ChecksumIEEE(record[4 : spillHeaderSize+len(data)])
+	binary.BigEndian.PutUint32(record[spillHeaderSize+len(data):], checksum)
+	if _, err := q.writer.Write(record); err != nil {
+		return err
+	}
+
+	last.size += recordSize
+	last.records++
+	q.size += recordSize
+	q.count++
+	q.stats.spilled.Add(1)
+	q.stats.spillBytes.Store(uint64(q.size))
+	return nil
+}
+
+// dropOldestLocked removes the first segment together with its unread records.
+func (q *spillQueue) dropOldestLocked() error {
+	dropped := q.segments[0].records - q.readRecords
+	q.stats.dropped.Add(uint64(dropped))
+	q.count -= dropped
+	q.head = nil
+	log.Printf("Spill queue %s is full, dropped %d messages", q.dir, dropped)
+	return q.nextSegmentLocked()
+}
+
+// nextSegmentLocked deletes the first segment and continues reading from the next one.
+func (q *spillQueue) nextSegmentLocked() error {
+	first := q.segments[0]
+	q.segments = q.segments[1:]
+	q.size -= first.size
+	q.readOffset = 0
+	q.readRecords = 0
+	q.stats.spillBytes.Store(uint64(q.size))
+
+	if err := q.openReader(); err != nil {
+		return err
+	}
+	if err := q.saveCursorLocked(); err != nil {
+		return err
+	}
+	return os.Remove(q.segmentPath(first.id))
+}
+
+// front returns the oldest unread message without removing it. Messages older than
+// spill_max_age are skipped.
+func (q *spillQueue) front() ([]byte, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.head == nil {
+		if q.count == 0 {
+			return nil, false, nil
+		}
+		first := q.segments[0]
+		if q.readOffset >= first.size {
+			if err := q.nextSegmentLocked(); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+
+		record, err := readSpillRecord(q.reader, q.readOffset, first.size)
+		if err != nil {
+			return nil, false, err
+		}
+		if q.maxAge > 0 && time.Since(record.timestamp) > q.maxAge {
+			q.stats.dropped.Add(1)
+			q.advanceLocked(record.end)
+			continue
+		}
+		q.head = record
+	}
+	return q.head.data, true, nil
+}
+
+// pop removes the message returned by front.
+func (q *spillQueue) pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.head == nil {
+		return nil
+	}
+	q.advanceLocked(q.head.end)
+	q.head = nil
+	return q.saveCursorLocked()
+}
+
+func (q *spillQueue) advanceLocked(offset int64) {
+	q.readOffset = offset
+	q.readRecords++
+	q.count--
+}
+
+func (q *spillQueue) saveCursorLocked() error {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf[:8], q.segments[0].id)
+	binary.BigEndian.PutUint64(buf[8:], uint64(q.readOffset))
+	_, err := q.cursor.WriteAt(buf, 0)
+	return err
+}
+
+func (q *spillQueue) close() {
+	for _, file := range []*os.File{q.writer, q.reader, q.cursor} {
+		if file != nil {
+			file.Close()
+		}
+	}
+}
+
+// drainSpill moves spilled messages into the message channel in order until the pipeline is stopped.
+// Messages not handed over remain in the queue for the next run.
+func (p *pipeline) drainSpill() {
+	defer p.inputs.Done()
+	for {
+		data, ok, err := p.spill.front()
+		if err != nil {
+			log.Printf("Error reading spill queue of %s, spilled messages are no longer delivered: %v", p.conf.InputStream, err)
+			return
+		}
+		if !ok {
+			select {
+			case <-p.spill.notify:
+				continue
+			case <-p.ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case p.msgChannel <- message{data: data}:
+		case <-p.ctx.Done():
+			return
+		}
+		if err := p.spill.pop(); err != nil {
+			log.Printf("Error updating spill queue of %s: %v", p.conf.InputStream, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package wasmlisher
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// pushSpill appends messages to the queue, the unread message channel forces them to be spilled.
+func pushSpill(t *testing.T, q *spillQueue, messages ...string) {
+	t.Helper()
+	full := make(chan message)
+	for _, msg := range messages {
+		if err := q.offer(full, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readSpill pops up to n messages from the queue.
+func readSpill(t *testing.T, q *spillQueue, n int) []string {
+	t.Helper()
+	var messages []string
+	for len(messages) < n {
+		data, ok, err := q.front()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			break
+		}
+		messages = append(messages, string(data))
+		if err := q.pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return messages
+}
+
+func TestSpillQueue(t *testing.T) {
+	dir := t.TempDir()
+	conf := StreamConf{InputStream: "spill"}
+	var stats pipelineStats
+	open := func() *spillQueue {
+		t.Helper()
+		q, err := openSpillQueue(dir, conf, &stats)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	q := open()
+	pushSpill(t, q, "m0", "m1", "m2", "m3", "m4")
+	if got := readSpill(t, q, 2); !slices.Equal(got, []string{"m0", "m1"}) {
+		t.Errorf("read %v before reopening", got)
+	}
+	q.close()
+
+	// Only messages that weren't read are recovered.
+	q = open()
+	if q.count != 3 {
+		t.Errorf("recovered %d messages, want 3", q.count)
+	}
+	if got := readSpill(t, q, 1); !slices.Equal(got, []string{"m2"}) {
+		t.Errorf("read %v after reopening", got)
+	}
+	pushSpill(t, q, "m5")
+	q.close()
+
+	// A torn write at the end of the segment is discarded.
+	segment := q.segmentPath(q.segments[len(q.segments)-1].id)
+	info, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(segment, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	q = open()
+	if got := readSpill(t, q, 10); !slices.Equal(got, []string{"m3", "m4"}) {
+		t.Errorf("read %v after truncating the tail", got)
+	}
+	q.close()
+
+	// Every record gets its own segment, the oldest ones are dropped to stay within the limit.
+	stats = pipelineStats{}
+	dir = filepath.Join(dir, "limited")
+	conf.SpillMaxBytes = 4 * (spillRecordSize + 2)
+	q = open()
+	pushSpill(t, q, "m0", "m1", "m2", "m3", "m4", "m5")
+	if dropped := stats.dropped.Load(); dropped != 2 {
+		t.Errorf("dropped %d messages, want 2", dropped)
+	}
+	// Messages larger than the limit are dropped as well.
+	pushSpill(t, q, string(make([]byte, conf.SpillMaxBytes)))
+	if dropped := stats.dropped.Load(); dropped != 3 {
+		t.Errorf("dropped %d messages, want 3", dropped)
+	}
+	if got := readSpill(t, q, 10); !slices.Equal(got, []string{"m2", "m3", "m4", "m5"}) {
+		t.Errorf("read %v from the limited queue", got)
+	}
+	q.close()
+}
@@ -1,12 +1,17 @@
 package wasmlisher
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
+	"errors"
 	"fmt"
 	wasmtimego "github.com/bytecodealliance/wasmtime-go/v21"
 	"io/ioutil"
 	"log"
 	"log/slog"
+	"math"
+	"time"
 )
 
 type Segment struct {
@@ -14,30 +19,358 @@ type Segment struct {
 	Data   any    `json:"data"`
 }
 
-func (w *Wasmlisher) RunWasmStream(wasmFilePath string, inputStream <-chan []byte, outputSubject string, env map[string]string) {
+const (
+	// epochTick is the interval at which the engine epoch is incremented.
+	// Calls are aborted up to two ticks after their timeout elapsed, never before.
+	epochTick = 10 * time.Millisecond
+	// noDeadline is the epoch deadline used when a stream has no timeout configured.
+	noDeadline = math.MaxUint32
+
+	memoryBlockSize = 1000000
+)
+
+var ErrExecutionTimeout = errors.New("execution timed out")
+
+// wasmInstance is a single instantiated plugin module together with its store
+// and the exports used by the host.
+type wasmInstance struct {
+	store     *wasmtimego.Store
+	memory    *wasmtimego.Memory
+	abi       abiVersion
+	alloc     *wasmtimego.Func
+	free      *wasmtimego.Func
+	process   *wasmtimego.Func
+	partition *wasmtimego.Func // Optional partition_key export
+	ptr       int32            // Fixed input/output buffer used by abiV0
+	maxMemory int64
+
+	// Optional lifecycle exports
+	onInit     *wasmtimego.Func
+	onTick     *wasmtimego.Func
+	onShutdown *wasmtimego.Func
+}
+
+// RunWasmStream loads the pipeline's WebAssembly module and processes every message
+// from the pipeline channel until it is closed. Errors preventing the module from
+// being loaded are returned instead of terminating the process, so that only this
+// pipeline is affected.
+func (w *Wasmlisher) RunWasmStream(p *pipeline) error {
 	// Read the WebAssembly file
-	code, err := ioutil.ReadFile(wasmFilePath)
+	code, err := ioutil.ReadFile(p.conf.LocalPath)
 	if err != nil {
-		log.Fatalf("Failed to read wasm file: %v", err)
+		return fmt.Errorf("failed to read wasm file: %w", err)
 	}
 
-	engine := wasmtimego.NewEngine()
+	hash := moduleHash(sha256.Sum256(code))
+	logs := newPluginLogger(p.conf, hash.short(), &p.stats.logsDropped)
 
-	store := wasmtimego.NewStore(engine)
+	fuel, err := newFuelMeter(p.conf)
+	if err != nil {
+		return err
+	}
+
+	kind := engineKindOf(p.conf)
+	engine := sharedEngine(kind)
+	sched := w.scheduler.newClass(p.conf, &p.stats.schedulerWait)
+	module, err := w.modules.acquire(kind, hash, code)
+	if err != nil {
+		return err
+	}
+	defer w.modules.release(kind, hash)
+
+	workers := max(p.conf.Workers, 1)
+	runners := make([]*streamRunner, 0, workers)
+	defer func() {
+		for _, r := range runners {
+			r.close()
+		}
+	}()
+	newRunner := func() (*streamRunner, error) {
+		instance, err := w.newWasmInstance(engine, module, p.conf, logs)
+		if err != nil {
+			return nil, err
+		}
+		return &streamRunner{
+			w:           w,
+			p:           p,
+			engine:      engine,
+			module:      module,
+			logs:        logs,
+			fuel:        fuel,
+			sched:       sched,
+			instance:    instance,
+			memoryWatch: &memoryWatch{threshold: p.conf.MemoryThreshold},
+		}, nil
+	}
+	for n := 0; n < workers; n++ {
+		r, err := newRunner()
+		if err != nil {
+			return err
+		}
+		runners = append(runners, r)
+	}
+
+	partitioner, err := newPartitioner(p.conf, workers, newRunner)
+	if err != nil {
+		return err
+	}
+	defer partitioner.close()
+
+	p.setRunning()
+
+	return w.runWorkers(p, runners, partitioner)
+}
+
+// streamRunner executes plugin calls of a single pipeline worker on its current instance, replacing
+// the instance whenever it traps due to a host enforced limit or outgrows its memory threshold.
+type streamRunner struct {
+	w           *Wasmlisher
+	p           *pipeline
+	engine      *wasmtimego.Engine
+	module      *wasmtimego.Module
+	logs        *pluginLogger
+	fuel        *fuelMeter
+	sched       *schedClass
+	instance    *wasmInstance
+	memoryWatch *memoryWatch
+}
+
+// serve processes jobs until the jobs channel is closed or ctx is cancelled, and calls the
+// plugin tick export in between. Once jobs is closed the plugin shutdown export is called.
+func (r *streamRunner) serve(ctx context.Context, jobs <-chan job, out *outputSequencer) error {
+	p := r.p
+
+	var ticks <-chan time.Time
+	if p.conf.TickInterval > 0 && r.instance.onTick != nil {
+		ticker := time.NewTicker(time.Duration(p.conf.TickInterval))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	for {
+		select {
+		case j, ok := <-jobs:
+			if !ok {
+				// The input is closed, let the plugin flush its state before it is dropped.
+				result, err := r.run("shutdown", func(i *wasmInstance) ([]byte, error) {
+					return i.shutdown(p.conf.Timeout)
+				})
+				if errors.Is(err, errPipelineStopped) {
+					return nil
+				}
+				out.publish(result)
+				return err
+			}
+			var callErr error
+			result, err := r.run("process", func(i *wasmInstance) ([]byte, error) {
+				result, err := i.call(j.msg.data, p.conf.Timeout)
+				if err == nil {
+					p.stats.processed.Add(1)
+				}
+				callErr = err
+				return result, err
+			})
+			if errors.Is(err, errPipelineStopped) {
+				// The message wasn't processed, the pipeline keeps draining its input.
+				out.complete(j, jobOutput{err: err})
+				continue
+			}
+			// Every job has to be completed, even without output, for ordered output to progress.
+			out.complete(j, jobOutput{data: result, callErr: callErr, err: err})
+			if err != nil {
+				return err
+			}
+		case now := <-ticks:
+			p.stats.ticks.Add(1)
+			result, err := r.run("tick", func(i *wasmInstance) ([]byte, error) {
+				return i.callTick(now, p.conf.Timeout)
+			})
+			if errors.Is(err, errPipelineStopped) {
+				continue
+			}
+			out.publish(result)
+			if err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+
+		if err := r.checkMemory(out); err != nil {
+			return err
+		}
+	}
+}
+
+// run invokes a plugin export through call under the stream fuel budget and returns its output.
+// Only errors that should stop the pipeline are returned, and errPipelineStopped if the export
+// wasn't called because the pipeline abandoned its buffered messages or has no fuel left to finish them.
+func (r *streamRunner) run(name string, call func(*wasmInstance) ([]byte, error)) ([]byte, error) {
+	p := r.p
+	if p.abandoned() {
+		return nil, errPipelineStopped
+	}
+	var budget uint64
+	if r.fuel != nil {
+		// Other workers of the stream may use up the window budget while this one waits for it.
+		for {
+			if err := r.w.waitForFuel(p, r.fuel); err != nil {
+				return nil, err
+			}
+			budget = r.fuel.budget(time.Now())
+			if budget > 0 {
+				break
+			}
+			if p.ctx.Err() != nil {
+				// The pipeline stops before the next window starts, the call would run out of fuel right away.
+				return nil, errPipelineStopped
+			}
+		}
+		if err := r.instance.store.SetFuel(budget); err != nil {
+			return nil, fmt.Errorf("failed to set fuel: %w", err)
+		}
+	}
+
+	r.sched.acquire()
+	resultData, err := call(r.instance)
+	r.sched.release()
+
+	if r.fuel != nil {
+		remaining, fuelErr := r.instance.store.GetFuel()
+		if fuelErr == nil && remaining <= budget {
+			r.fuel.record(budget - remaining)
+			p.stats.fuelConsumed.Add(budget - remaining)
+		}
+	}
 
-	module, err := wasmtimego.NewModule(engine, code)
 	if err != nil {
-		log.Fatalf("Failed to compile module: %v", err)
+		switch {
+		case errors.Is(err, ErrExecutionTimeout):
+			p.stats.timeouts.Add(1)
+			log.Printf("Function %s call on %s aborted after %s, resetting instance", name, p.conf.InputStream, time.Duration(p.conf.Timeout))
+		case errors.Is(err, ErrFuelExhausted):
+			p.stats.fuelExhausted.Add(1)
+			log.Printf("Function %s call on %s ran out of fuel (budget %d), resetting instance", name, p.conf.InputStream, budget)
+		case errors.Is(err, ErrMemoryLimitExceeded):
+			p.stats.memoryLimitHits.Add(1)
+			log.Printf("Function %s call on %s failed, resetting instance: %v", name, p.conf.InputStream, err)
+		default:
+			log.Printf("Function %s call failed: %v", name, err)
+			return nil, nil
+		}
+
+		if err := r.replace(); err != nil {
+			return nil, fmt.Errorf("failed to reset instance: %w", err)
+		}
+		return nil, nil
+	}
+	return resultData, nil
+}
+
+// checkMemory recreates the instance once its memory stayed above the stream threshold for too long.
+func (r *streamRunner) checkMemory(out *outputSequencer) error {
+	p := r.p
+	memorySize := uint64(r.instance.memory.DataSize(r.instance.store))
+	p.stats.memoryBytes.Store(memorySize)
+	if !r.memoryWatch.observe(memorySize) {
+		return nil
+	}
+
+	p.stats.recycled.Add(1)
+	log.Printf("Memory of %s stayed above %d bytes for %d calls, recreating instance", p.conf.InputStream, p.conf.MemoryThreshold, memoryRecycleAfter)
+
+	// The instance is healthy, so it gets the chance to hand over its state.
+	if result, err := r.instance.shutdown(p.conf.Timeout); err != nil {
+		log.Printf("Function shutdown call on %s failed: %v", p.conf.InputStream, err)
+	} else {
+		out.publish(result)
+	}
+	if err := r.replace(); err != nil {
+		return fmt.Errorf("failed to recycle instance: %w", err)
+	}
+	return nil
+}
+
+// replace closes the current instance and creates a new one from the same module.
+func (r *streamRunner) replace() error {
+	r.instance.close()
+	instance, err := r.w.newWasmInstance(r.engine, r.module, r.p.conf, r.logs)
+	r.instance = instance
+	return err
+}
+
+func (r *streamRunner) close() {
+	if r.instance != nil {
+		r.instance.close()
+	}
+}
+
+// waitForFuel enforces the stream fuel window budget. Once the budget is used up the stream is
+// either paused until the next window starts or disabled, depending on the configured policy.
+func (w *Wasmlisher) waitForFuel(p *pipeline, fuel *fuelMeter) error {
+	exhausted, windowEnd := fuel.exhausted(time.Now())
+	if !exhausted {
+		return nil
+	}
+	if p.conf.FuelExceeded == FuelExceededDisable {
+		return fmt.Errorf("%w: %d fuel used within %s", ErrFuelBudgetExceeded, p.conf.FuelPerWindow, time.Duration(p.conf.FuelWindow))
+	}
+
+	p.stats.throttled.Add(1)
+	log.Printf("Stream %s used its fuel budget, throttling until %s", p.conf.InputStream, windowEnd.Format(time.RFC3339))
+	select {
+	case <-time.After(time.Until(windowEnd)):
+	case <-p.ctx.Done():
+	}
+	return nil
+}
+
+// startEpochTicker increments the engine epoch every epochTick.
+func startEpochTicker(engine *wasmtimego.Engine) {
+	ticker := time.NewTicker(epochTick)
+	go func() {
+		for range ticker.C {
+			engine.IncrementEpoch()
+		}
+	}()
+}
+
+// epochDeadline converts a timeout into a number of epoch ticks. The first tick may follow
+// right after the deadline is set, so one tick more than the timeout spans is needed.
+func epochDeadline(timeout Duration) uint64 {
+	if timeout <= 0 {
+		return noDeadline
+	}
+	return uint64((time.Duration(timeout)+epochTick-1)/epochTick) + 1
+}
+
+func (w *Wasmlisher) newWasmInstance(engine *wasmtimego.Engine, module *wasmtimego.Module, conf StreamConf, logs *pluginLogger) (*wasmInstance, error) {
+	store := wasmtimego.NewStore(engine)
+	created := false
+	defer func() {
+		if !created {
+			store.Close()
+		}
+	}()
+	// Module start functions and allocation are not subject to the stream timeout or fuel budget.
+	store.SetEpochDeadline(noDeadline)
+	if conf.MaxMemory > 0 {
+		store.Limiter(conf.MaxMemory, -1, -1, -1, -1)
+	}
+	if conf.fuelEnabled() {
+		if err := store.SetFuel(unlimitedFuel); err != nil {
+			return nil, fmt.Errorf("failed to set fuel: %w", err)
+		}
 	}
 
 	wasiConfig := wasmtimego.NewWasiConfig()
 
-	wasiConfig.InheritStdout()
+	logs.captureOutput(wasiConfig)
 
-	keys := make([]string, 0, len(env))
-	values := make([]string, 0, len(env))
+	keys := make([]string, 0, len(conf.Env))
+	values := make([]string, 0, len(conf.Env))
 
-	for k, v := range env {
+	for k, v := range conf.Env {
 		keys = append(keys, k)
 		values = append(values, v)
 	}
@@ -46,105 +379,182 @@ func (w *Wasmlisher) RunWasmStream(wasmFilePath string, inputStream <-chan []byt
 	store.SetWasi(wasiConfig)
 
 	linker := wasmtimego.NewLinker(engine)
-	err = linker.DefineWasi()
+	err := linker.DefineWasi()
 	if err != nil {
-		log.Fatalf("Failed to define WASI: %v", err)
+		return nil, fmt.Errorf("failed to define WASI: %w", err)
+	}
+	if err := w.defineHostFunctions(linker, conf, logs); err != nil {
+		return nil, fmt.Errorf("failed to define host functions: %w", err)
 	}
 
 	instance, err := linker.Instantiate(store, module)
 	if err != nil {
-		log.Fatalf("Failed to instantiate module: %v", err)
+		return nil, fmt.Errorf("failed to instantiate module: %w", err)
 	}
 
-	alloc := instance.GetExport(store, "malloc").Func()
+	alloc := exportedFunc(store, instance, "malloc")
 	if alloc == nil {
-		log.Fatalf("Failed to get malloc function")
+		return nil, fmt.Errorf("failed to get malloc function")
 	}
 
-	process := instance.GetExport(store, "process").Func()
+	process := exportedFunc(store, instance, "process")
 	if process == nil {
-		log.Fatalf("Failed to get process function")
+		return nil, fmt.Errorf("failed to get process function")
 	}
 
 	// Access the memory
-	memory := instance.GetExport(store, "memory").Memory()
+	memory := exportedMemory(store, instance, "memory")
 	if memory == nil {
-		log.Fatalf("Failed to get memory")
+		return nil, fmt.Errorf("failed to get memory")
 	}
 
-	memory.Grow(store, 50)
-	memoryData := memory.UnsafeData(store)
-	memorySize := int32(len(memoryData))
-	fmt.Printf("Memory size: %d bytes\n", memorySize)
+	if err := growInitialMemory(store, memory, conf.InitialPages, conf.MaxMemory); err != nil {
+		return nil, err
+	}
 
-	const memoryBlockSize = 1000000
+	abi, err := negotiateABI(store, instance, process)
+	if err != nil {
+		return nil, err
+	}
 
-	if memoryBlockSize > memorySize {
-		log.Fatalf("Memory block size %d exceeds memory size %d", memoryBlockSize, memorySize)
+	wi := &wasmInstance{
+		store:     store,
+		memory:    memory,
+		abi:       abi,
+		alloc:     alloc,
+		free:      exportedFunc(store, instance, "free"),
+		process:   process,
+		partition: exportedFunc(store, instance, partitionKeyExport),
+		maxMemory: conf.MaxMemory,
+	}
+	if err := wi.setupABI(); err != nil {
+		return nil, err
+	}
+	if err := wi.setupLifecycle(instance); err != nil {
+		return nil, err
+	}
+	if err := wi.initialize(conf.Config, conf.Timeout); err != nil {
+		return nil, err
 	}
 
-	// Allocate a fixed memory block once
-	ptrVal, err := alloc.Call(store, memoryBlockSize)
+	created = true
+	return wi, nil
+}
+
+// close releases the instance store. Closing the store also closes the captured plugin output.
+func (i *wasmInstance) close() {
+	i.store.Close()
+}
+
+// call runs the process export on a single input message and returns the plugin output.
+// The call is aborted with ErrExecutionTimeout once the timeout elapses.
+// The returned slice may reference instance memory and is only valid until the next call.
+func (i *wasmInstance) call(tx []byte, timeout Duration) ([]byte, error) {
+	i.store.GC()
+
+	i.store.SetEpochDeadline(epochDeadline(timeout))
+	defer i.store.SetEpochDeadline(noDeadline)
+
+	var result []byte
+	var err error
+	switch i.abi {
+	case abiV1:
+		result, err = i.callV1(tx)
+	default:
+		result, err = i.callV0(tx)
+	}
 	if err != nil {
-		log.Fatalf("Failed to allocate memory: %v", err)
+		return nil, i.classifyError(err)
 	}
-	ptr := ptrVal.(int32)
+	return result, nil
+}
 
-	// Ensure ptr is within bounds
-	if ptr < 0 || ptr+memoryBlockSize > memorySize {
-		log.Fatalf("Allocated pointer is out of memory bounds: %d", ptr)
+// classifyError maps traps caused by host enforced limits to their sentinel errors.
+func (i *wasmInstance) classifyError(err error) error {
+	if isTrapCode(err, wasmtimego.Interrupt) {
+		return ErrExecutionTimeout
 	}
-	// Process each transaction from the input stream
-	for tx := range inputStream {
-		txSize := int32(len(tx))
-		if txSize > memoryBlockSize {
-			log.Printf("Transaction size %d exceeds allocated memory block size %d", txSize, memoryBlockSize)
-			continue
-		}
-		store.GC()
-		// Zero out the allocated memory block before copying new data
-		for i := int32(0); i < memoryBlockSize; i++ {
-			memoryData[ptr+i] = 0
-		}
+	if isTrapCode(err, wasmtimego.OutOfFuel) {
+		return ErrFuelExhausted
+	}
+	// Growing memory past the limit isn't a trap, memory.grow returns -1 to the plugin, which
+	// usually traps shortly after when its allocator gives up. The store limiter of wasmtime-go
+	// doesn't report refused growth, so the limit is assumed to be hit when a trap happens with
+	// less than a tenth of the limit, or a single page, left. Plugins that trap for other reasons
+	// while using that much memory are reported as hitting the limit as well.
+	if isWasmError(err) && i.maxMemory > 0 && i.maxMemory-int64(i.memory.DataSize(i.store)) < max(i.maxMemory/10, wasmPageSize) {
+		return fmt.Errorf("%w: %d bytes: %v", ErrMemoryLimitExceeded, i.maxMemory, err)
+	}
+	return err
+}
 
-		// Copy the transaction data to the allocated space in memory
-		copy(memoryData[ptr:ptr+txSize], tx)
+// isWasmError reports whether err originates from wasm execution rather than from host side checks.
+func isWasmError(err error) bool {
+	var trap *wasmtimego.Trap
+	var wasmErr *wasmtimego.Error
+	return errors.As(err, &trap) || errors.As(err, &wasmErr)
+}
 
-		// Process the transaction
-		resultVal, err := process.Call(store, ptr, txSize)
-		if err != nil {
-			log.Printf("Process function call failed: %v", err)
-			continue
-		}
-		size := resultVal.(int32)
-		if size == 0 {
-			continue
-		}
+// isTrapCode reports whether err is a wasm trap with the given code.
+func isTrapCode(err error, code wasmtimego.TrapCode) bool {
+	var trap *wasmtimego.Trap
+	if !errors.As(err, &trap) {
+		return false
+	}
+	trapCode := trap.Code()
+	return trapCode != nil && *trapCode == code
+}
 
-		resultData := memoryData[ptr : ptr+size]
+// exportedFunc returns the named function export or nil if the module does not export a function with that name.
+func exportedFunc(store wasmtimego.Storelike, instance *wasmtimego.Instance, name string) *wasmtimego.Func {
+	export := instance.GetExport(store, name)
+	if export == nil {
+		return nil
+	}
+	return export.Func()
+}
 
-		w.PublishWasmData(resultData, outputSubject)
+// exportedMemory returns the named memory export or nil if the module does not export a memory with that name.
+func exportedMemory(store wasmtimego.Storelike, instance *wasmtimego.Instance, name string) *wasmtimego.Memory {
+	export := instance.GetExport(store, name)
+	if export == nil {
+		return nil
 	}
+	return export.Memory()
+}
+
+// PublishWasmData publishes plugin output to subject. Output that is a JSON array of segments is
+// published as one message per segment, to subject suffixed with the segment suffix. Segments that
+// fail to publish don't prevent the remaining ones from being published, the errors are returned.
+func (w *Wasmlisher) PublishWasmData(data []byte, subject string) error {
+	return publishSegments(data, subject, func(data []byte, subject string, _ int) error {
+		return w.Publisher.PublishBufTo(data, subject)
+	})
 }
 
-func (w *Wasmlisher) PublishWasmData(data []byte, subject string) {
+// publishSegments splits plugin output into segments like PublishWasmData and passes every segment
+// to publish together with its index. Unsegmented output is passed as segment 0.
+func publishSegments(data []byte, subject string, publish func(data []byte, subject string, segment int) error) error {
 	// Try to unmarshal the data into the expected segments structure.
 	var segments []Segment
+	var errs []error
 	err := json.Unmarshal(data, &segments)
 	// If unmarshaling into segments is successful, publish each segment.
 	if err == nil {
 		// Data unmarshaled successfully, publish each segment.
-		for _, segment := range segments {
+		for n, segment := range segments {
 			segmentSubject := subject + "." + segment.Suffix
 			msgBytes, err := json.Marshal(segment.Data)
 			if err != nil {
-				slog.Error("Failed to serialize message:", err)
+				slog.Error("Failed to serialize message", "err", err)
+				errs = append(errs, err)
 				continue
 			}
 
-			err = w.Publisher.PublishBufTo(msgBytes, segmentSubject)
+			err = publish(msgBytes, segmentSubject, n)
 			if err != nil {
 				log.Printf("Failed to publish processed data for subject %s: %v", segmentSubject, err)
+				errs = append(errs, err)
 			} else {
 				fmt.Printf("Published segmented data for subject %s\n", segmentSubject)
 			}
@@ -152,11 +562,13 @@ func (w *Wasmlisher) PublishWasmData(data []byte, subject string) {
 	} else {
 		// If no segmentation, publish the data as is.
 		test := string(data)
-		err := w.Publisher.PublishBufTo([]byte(test), subject)
+		err := publish([]byte(test), subject, 0)
 		if err != nil {
 			log.Printf("Failed to publish processed data for subject %s: %v", subject, err)
+			errs = append(errs, err)
 		} else {
 			fmt.Printf("Published full data for subject %s\n", subject)
 		}
 	}
+	return errors.Join(errs...)
 }
@@ -11,28 +11,89 @@ import (
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
 type Wasmlisher struct {
-	Publisher   *dlsdk.Service
-	config      string
-	cfInterval  int
-	streams     []StreamConf
-	msgChannels map[string]chan []byte
-	active      bool
+	Publisher  *dlsdk.Service
+	kv         KVStore
+	modules    *moduleCache
+	scheduler  *scheduler
+	spillDir   string
+	queueGroup string
+	subConn    *queueConn // Wraps Publisher.SubNats to subscribe within queue groups
+	config     string
+	cfInterval int
+	streams    []StreamConf
+	pipelines  *pipelineManager
+	ctx        context.Context
+	cancel     context.CancelFunc
+	reloader   sync.WaitGroup
 }
 
-func New(publisherOptions []dlsdkOptions.Option, config string, configInterval int) *Wasmlisher {
+// Option configures optional Wasmlisher features.
+type Option func(*Wasmlisher)
+
+// WithKVStore sets the store backing plugin state. An in-memory store is used by default.
+func WithKVStore(store KVStore) Option {
+	return func(w *Wasmlisher) {
+		w.kv = store
+	}
+}
+
+// WithModuleCache stores precompiled modules in dir and loads them from it on later starts.
+func WithModuleCache(dir string) Option {
+	return func(w *Wasmlisher) {
+		w.modules = newModuleCache(dir)
+	}
+}
+
+// WithMaxConcurrency limits the number of plugin calls executing at the same time across all streams.
+// Calls are unlimited by default.
+func WithMaxConcurrency(limit int) Option {
+	return func(w *Wasmlisher) {
+		w.scheduler = newScheduler(limit)
+	}
+}
+
+// WithSpillDir sets the directory holding the disk spill queues of spill-to-disk streams.
+func WithSpillDir(dir string) Option {
+	return func(w *Wasmlisher) {
+		w.spillDir = dir
+	}
+}
+
+// WithQueueGroup subscribes nats inputs within the given queue group, unless a stream sets its own,
+// so that replicas running the same config share the messages of a subject.
+func WithQueueGroup(group string) Option {
+	return func(w *Wasmlisher) {
+		w.queueGroup = group
+	}
+}
+
+func New(publisherOptions []dlsdkOptions.Option, config string, configInterval int, opts ...Option) *Wasmlisher {
+	ctx, cancel := context.WithCancel(context.Background())
 	ret := &Wasmlisher{
-		Publisher:   &dlsdk.Service{},
-		config:      config,
-		msgChannels: make(map[string]chan []byte),
-		cfInterval:  configInterval,
-		active:      true,
+		Publisher:  &dlsdk.Service{},
+		kv:         NewMemoryKVStore(),
+		modules:    newModuleCache(""),
+		config:     config,
+		cfInterval: configInterval,
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	for _, opt := range opts {
+		opt(ret)
 	}
+	ret.pipelines = newPipelineManager(ret.subscribeToStream)
 
 	ret.Publisher.Configure(publisherOptions...)
+	if ret.Publisher.SubNats != nil {
+		ret.subConn = newQueueConn(ret.Publisher.SubNats)
+		ret.Publisher.SubNats = ret.subConn
+	}
+	ret.Publisher.AddStatusCallback(ret.pipelines.Status)
 
 	return ret
 }
@@ -45,59 +106,134 @@ func (w *Wasmlisher) loadAndApplyConfig() {
 		return
 	}
 
-	newStreamMap := make(map[string]StreamConf)
-	for _, stream := range newStreams {
-		newStreamMap[stream.InputStream] = stream
+	added, removed, changed := DiffStreams(w.streams, newStreams)
+
+	for _, stream := range removed {
+		log.Printf("Stream %s removed from config, stopping pipeline\n", stream.InputStream)
+		w.pipelines.Remove(stream.InputStream)
 	}
 
-	for input, ch := range w.msgChannels {
-		if _, exists := newStreamMap[input]; !exists {
-			close(ch)
-			delete(w.msgChannels, input)
+	for _, stream := range changed {
+		log.Printf("Stream %s changed in config, restarting pipeline\n", stream.InputStream)
+		if err := w.pipelines.Replace(stream); err != nil {
+			log.Printf("Error restarting pipeline %s: %v\n", stream.InputStream, err)
 		}
 	}
 
-	for _, stream := range newStreams {
-		if _, exists := w.msgChannels[stream.InputStream]; !exists {
-			w.subscribeToStream(stream)
+	for _, stream := range added {
+		if err := w.pipelines.Add(stream); err != nil {
+			log.Printf("Error starting pipeline %s: %v\n", stream.InputStream, err)
 		}
 	}
 
 	w.streams = newStreams
+
+	w.pipelines.RetryFailed()
+
+	// Drop compiled modules of streams that were removed or switched to a different file.
+	w.modules.prune()
 }
 
 func (w *Wasmlisher) reloadConfigPeriodically() {
-	for w.active {
+	defer w.reloader.Done()
+	for {
 		w.loadAndApplyConfig()
-		time.Sleep(time.Duration(w.cfInterval) * time.Second)
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(time.Duration(w.cfInterval) * time.Second):
+		}
 	}
 }
 
-func (w *Wasmlisher) subscribeToStream(stream StreamConf) {
-	msgChannel := make(chan []byte, 100)
-	w.msgChannels[stream.InputStream] = msgChannel
+func (w *Wasmlisher) subscribeToStream(stream StreamConf) (*pipeline, error) {
+	if err := stream.validateBackpressure(); err != nil {
+		return nil, err
+	}
+	if err := stream.validateMode(); err != nil {
+		return nil, err
+	}
+	p := newPipeline(stream)
+
+	if stream.Overflow == OverflowSpill {
+		if err := w.openSpill(p); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.subscribeInput(p); err != nil {
+		// Releases the spill queue, if any.
+		p.stop()
+		return nil, err
+	}
+
+	p.running.Add(1)
+	go func() {
+		defer p.running.Done()
+		if err := w.RunWasmStream(p); err != nil {
+			p.fail(err)
+		}
+	}()
+
+	return p, nil
+}
 
-	switch stream.InputType {
-	case "nats":
-		_, err := w.Publisher.SubscribeTo(w.handlerInputStreamFactory(stream.InputStream), stream.InputStream)
+// subscribeInput starts receiving messages of the pipeline input.
+func (w *Wasmlisher) subscribeInput(p *pipeline) error {
+	switch p.conf.InputType {
+	case InputNats:
+		if p.conf.Mode == ModeReply {
+			return w.serveRequests(p)
+		}
+		sub, err := w.subscribeNats(p)
 		if err != nil {
-			log.Printf("Error subscribing to NATS stream: %v\n", err)
-			return
+			return fmt.Errorf("error subscribing to NATS stream: %w", err)
 		}
-	case "unix_socket":
-		if err := w.createAndHandleUnixSocket(stream.InputStream, msgChannel); err != nil {
-			log.Printf("Error setting up Unix socket %s: %v", stream.InputStream, err)
-			return
+		p.sub = sub
+	case InputJetStream:
+		if err := w.subscribeJetStream(p); err != nil {
+			return fmt.Errorf("error subscribing to JetStream consumer: %w", err)
+		}
+	case InputUnixSocket:
+		if err := w.createAndHandleUnixSocket(p); err != nil {
+			return fmt.Errorf("error setting up Unix socket %s: %w", p.conf.InputStream, err)
 		}
 	default:
-		log.Printf("Unsupported input type: %s\n", stream.InputType)
-		return
+		return fmt.Errorf("unsupported input type: %s", p.conf.InputType)
+	}
+	return nil
+}
+
+// queueGroupOf returns the queue group of a stream subscription, or an empty string if the stream
+// subscribes on its own.
+func (w *Wasmlisher) queueGroupOf(conf StreamConf) string {
+	if conf.QueueGroup != "" {
+		return conf.QueueGroup
+	}
+	return w.queueGroup
+}
+
+// openSpill opens the disk spill queue of the pipeline and starts moving spilled messages,
+// including those left over from a previous run, into the message channel.
+func (w *Wasmlisher) openSpill(p *pipeline) error {
+	if w.spillDir == "" {
+		return fmt.Errorf("overflow policy %s requires a spill directory", OverflowSpill)
+	}
+	spill, err := openSpillQueue(spillDir(w.spillDir, p.conf), p.conf, &p.stats)
+	if err != nil {
+		return err
 	}
+	p.spill = spill
 
-	go w.RunWasmStream(stream.LocalPath, msgChannel, stream.OutputStream, stream.Env)
+	p.inputs.Add(1)
+	go p.drainSpill()
+	return nil
 }
 
-func (w *Wasmlisher) createAndHandleUnixSocket(socketPath string, msgChannel chan []byte) error {
+func (w *Wasmlisher) createAndHandleUnixSocket(p *pipeline) error {
+	socketPath := p.conf.InputStream
+
 	// Remove existing socket if present
 	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to remove existing Unix socket %s: %w", socketPath, err)
@@ -107,31 +243,54 @@ func (w *Wasmlisher) createAndHandleUnixSocket(socketPath string, msgChannel cha
 	if err != nil {
 		return fmt.Errorf("error listening on Unix socket %s: %v", socketPath, err)
 	}
+	p.listener = listener
 
+	p.inputs.Add(1)
 	go func() {
-		defer listener.Close()
+		defer p.inputs.Done()
 		for {
 			conn, err := listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				log.Printf("Error accepting Unix socket connection: %v", err)
 				continue
 			}
-			go w.handleUnixSocketConnection(conn, msgChannel)
+			if !p.trackConn(conn) {
+				conn.Close()
+				return
+			}
+			p.inputs.Add(1)
+			go func() {
+				defer p.inputs.Done()
+				defer p.untrackConn(conn)
+				w.handleUnixSocketConnection(conn, p)
+			}()
 		}
 	}()
 	return nil
 }
 
-func (w *Wasmlisher) handleUnixSocketConnection(conn net.Conn, msgChannel chan []byte) {
+// lengthPrefixSize is the size of the ASCII decimal length prefix of Unix socket frames.
+const lengthPrefixSize = 10
+
+func (w *Wasmlisher) handleUnixSocketConnection(conn net.Conn, p *pipeline) {
 	defer conn.Close()
-	const lengthPrefixSize = 10
+
+	var replies *socketReplies
+	if p.conf.Mode == ModeReply {
+		replies = newSocketReplies(conn, p)
+		// Replies to frames that were already read are still written once the producer stops sending.
+		defer replies.wait()
+	}
 
 	for {
 		// Read length prefix
 		lengthPrefix := make([]byte, lengthPrefixSize)
 		_, err := io.ReadFull(conn, lengthPrefix)
 		if err != nil {
-			if err != io.EOF {
+			if err != io.EOF && p.ctx.Err() == nil {
 				log.Printf("Error reading length prefix from Unix socket: %v", err)
 			}
 			break
@@ -139,50 +298,62 @@ func (w *Wasmlisher) handleUnixSocketConnection(conn net.Conn, msgChannel chan [
 
 		// Parse the length
 		messageLength, err := strconv.Atoi(string(lengthPrefix))
+		if err == nil && messageLength < 0 {
+			err = fmt.Errorf("negative length %d", messageLength)
+		}
 		if err != nil {
 			log.Printf("Invalid length prefix: %v", err)
 			break
 		}
 
 		// Read the actual message
-		message := make([]byte, messageLength)
-		_, err = io.ReadFull(conn, message)
+		data := make([]byte, messageLength)
+		_, err = io.ReadFull(conn, data)
 		if err != nil {
-			log.Printf("Error reading message from Unix socket: %v", err)
+			if p.ctx.Err() == nil {
+				log.Printf("Error reading message from Unix socket: %v", err)
+			}
 			break
 		}
 
-		msgChannel <- message
+		msg := message{data: data}
+		if replies != nil {
+			msg.reply = replies.add()
+		}
+		if !p.deliver(msg) {
+			msg.done(errPipelineStopped)
+			break
+		}
 	}
 }
 
 // Factory function to create a handler function bound to a specific stream's channel
-func (w *Wasmlisher) handlerInputStreamFactory(streamSubject string) func(dlsdk.Message) {
+func (w *Wasmlisher) handlerInputStreamFactory(p *pipeline) func(dlsdk.Message) {
 	return func(msg dlsdk.Message) {
-		if msgChannel, ok := w.msgChannels[streamSubject]; ok {
-			msgChannel <- msg.Data()
-		}
+		p.deliver(message{data: msg.Data()})
 	}
 }
 
 func (w *Wasmlisher) Start() context.Context {
+	w.reloader.Add(1)
 	go w.reloadConfigPeriodically()
 
 	return w.Publisher.Start()
 }
 
 func (w *Wasmlisher) Close() error {
-	w.active = false
-	for _, ch := range w.msgChannels {
-		close(ch)
+	w.cancel()
+	w.reloader.Wait()
+	w.pipelines.Close()
+
+	var err []error
+	if errKV := w.kv.Close(); errKV != nil {
+		err = append(err, errKV)
 	}
-	w.msgChannels = make(map[string]chan []byte) // Reset msgChannels to clean up
 
 	log.Println("Wasmlisher.Close")
 	w.Publisher.Cancel(nil)
 
-	var err []error
-
 	log.Println("Waiting on Wasmlisher publisher group")
 	errGr := w.Publisher.Group.Wait()
 	if !errors.Is(errGr, context.Canceled) {
@@ -0,0 +1,188 @@
+package wasmlisher
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// job is an input message together with its position in the input stream.
+type job struct {
+	seq uint64
+	msg message
+}
+
+// runWorkers feeds the pipeline input to the stream runners, one per configured worker, until
+// the input is closed. Without a partitioner, every message goes to the next idle runner.
+// If a runner fails, the remaining runners are stopped and its error returned.
+func (w *Wasmlisher) runWorkers(p *pipeline, runners []*streamRunner, partitioner *partitioner) error {
+	// Pipeline cancellation must not stop the runners, they stop once the input is drained.
+	g, ctx := errgroup.WithContext(context.Background())
+	out, err := newOutputSequencer(w, p.conf)
+	if err != nil {
+		return err
+	}
+
+	queues := make([]chan job, 1)
+	if partitioner != nil {
+		queues = make([]chan job, len(runners))
+	}
+	for n := range queues {
+		queues[n] = make(chan job)
+	}
+
+	g.Go(func() error {
+		defer func() {
+			for _, queue := range queues {
+				close(queue)
+			}
+		}()
+		var seq uint64
+		for msg := range p.msgChannel {
+			queue := queues[0]
+			if partitioner != nil {
+				n, err := partitioner.partition(msg.data)
+				if err != nil {
+					return err
+				}
+				queue = queues[n]
+			}
+
+			select {
+			case queue <- job{seq: seq, msg: msg}:
+				seq++
+			case <-p.abandon:
+				msg.done(errPipelineStopped)
+			case <-ctx.Done():
+				return nil
+			}
+		}
+		return nil
+	})
+
+	for n, r := range runners {
+		r, jobs := r, queues[n%len(queues)]
+		g.Go(func() error {
+			return r.serve(ctx, jobs, out)
+		})
+	}
+
+	return g.Wait()
+}
+
+// outputSequencer publishes plugin output of a stream. For ordered streams, output of jobs
+// completed out of order is held back until all preceding jobs completed.
+type outputSequencer struct {
+	w       *Wasmlisher
+	subject string
+	ordered bool
+	js      *jetStreamOutput // Set when output is published to JetStream
+
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]jobOutput
+}
+
+// jobOutput is the outcome of a job.
+type jobOutput struct {
+	msg     message
+	data    []byte
+	callErr error // Error of the plugin call, which only fails this message
+	err     error // Error that stopped the pipeline before the message was processed
+}
+
+func newOutputSequencer(w *Wasmlisher, conf StreamConf) (*outputSequencer, error) {
+	s := &outputSequencer{
+		w:       w,
+		subject: conf.OutputStream,
+		ordered: conf.Ordered && conf.Workers > 1,
+		pending: make(map[uint64]jobOutput),
+	}
+	switch conf.OutputMode {
+	case "", OutputNats:
+	case OutputJetStream:
+		js, err := w.newJetStreamOutput()
+		if err != nil {
+			return nil, err
+		}
+		s.js = js
+	default:
+		return nil, fmt.Errorf("unsupported output mode: %s", conf.OutputMode)
+	}
+	return s, nil
+}
+
+// complete records the outcome of a job, whose output may be empty. The job message is
+// acknowledged once its output was published.
+func (s *outputSequencer) complete(j job, output jobOutput) {
+	output.msg = j.msg
+	if !s.ordered {
+		s.finish(output)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if j.seq != s.next {
+		// Output may reference instance memory, which is reused by the next call.
+		output.data = bytes.Clone(output.data)
+		s.pending[j.seq] = output
+		return
+	}
+
+	s.finish(output)
+	s.next++
+	for {
+		output, ok := s.pending[s.next]
+		if !ok {
+			return
+		}
+		delete(s.pending, s.next)
+		s.finish(output)
+		s.next++
+	}
+}
+
+// finish publishes the output of a job, or replies with it in reply mode, and reports the outcome
+// to the input of its message.
+func (s *outputSequencer) finish(output jobOutput) {
+	msg := output.msg
+	switch {
+	case msg.reply != nil:
+		err := output.err
+		if err == nil {
+			err = output.callErr
+		}
+		msg.reply(output.data, err)
+	case output.err != nil:
+		msg.done(output.err)
+	case output.callErr != nil:
+		// A failed call has no output, the message is redelivered if its input supports it.
+		msg.done(output.callErr)
+	default:
+		msg.done(s.publishMsg(output.data, msg.id))
+	}
+}
+
+// publish publishes output that doesn't belong to an input message right away, regardless of ordering.
+func (s *outputSequencer) publish(data []byte) error {
+	if s.subject == "" {
+		// Streams in reply mode don't need an output subject.
+		return nil
+	}
+	return s.publishMsg(data, "")
+}
+
+// publishMsg publishes the output of the input message with the given id, which may be empty.
+func (s *outputSequencer) publishMsg(data []byte, id string) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if s.js != nil {
+		return s.js.publish(data, s.subject, id)
+	}
+	return s.w.PublishWasmData(data, s.subject)
+}